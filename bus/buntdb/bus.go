@@ -0,0 +1,503 @@
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/arkgo/asset/util"
+	"github.com/arkgo/driver/kit"
+	"github.com/tidwall/buntdb"
+)
+
+//-------------------- fileBus begin -------------------------
+//单机持久化的队列，消息和延时事件存在本地文件，重启后继续处理
+//队列的key为 bus:queue:名称:到期时间:序号，延时事件为 bus:event:到期时间:序号
+//按key顺序遍历即是按到期时间顺序
+
+const (
+	fileBusQueueKey = "bus:queue:"
+	fileBusEventKey = "bus:event:"
+)
+
+//支持的扩展
+var (
+	_ kit.EnvelopeBus = (*fileBusConnect)(nil)
+	_ kit.ErrorBus    = (*fileBusConnect)(nil)
+	_ kit.InspectBus  = (*fileBusConnect)(nil)
+)
+
+type (
+	fileBusDriver struct {
+		store string
+	}
+	fileBusQueue struct {
+		Thread  int
+		Handler kit.EnvelopeHandler
+		Actives *int64 //处理中的数量
+	}
+	fileBusConnect struct {
+		mutex   sync.RWMutex
+		running bool
+		actives int64
+
+		name    string
+		config  ark.BusConfig
+		setting fileBusSetting
+
+		eventHandler ark.EventHandler
+		queueHandler ark.QueueHandler
+
+		errorEventHandler kit.ErrorHandler
+		errorQueueHandler kit.ErrorHandler
+
+		envelopeEventHandler kit.EnvelopeHandler
+		envelopeQueueHandler kit.EnvelopeHandler
+
+		db      *buntdb.DB
+		stopper *util.Stopper
+		serial  int64
+
+		events map[string]kit.EnvelopeHandler
+		queues map[string]fileBusQueue
+		wakes  map[string]chan struct{}
+	}
+	fileBusSetting struct {
+		Store      string
+		Interval   time.Duration //空闲时轮询的间隔
+		Visibility time.Duration //取出后多久未完成，重新投递
+
+		Retries kit.Retries //重试策略，可以按队列单独配置
+	}
+	fileBusValue struct {
+		Name    string `json:"name"`
+		Data    []byte `json:"data"`
+		Attempt int    `json:"attempt"`
+	}
+)
+
+//连接
+func (driver *fileBusDriver) Connect(name string, config ark.BusConfig) (ark.BusConnect, error) {
+
+	//获取配置信息
+	setting := fileBusSetting{
+		Store: driver.store, Interval: time.Second, Visibility: time.Second * 30,
+	}
+
+	if vv, ok := config.Setting["file"].(string); ok && vv != "" {
+		setting.Store = vv
+	}
+	if vv, ok := config.Setting["store"].(string); ok && vv != "" {
+		setting.Store = vv
+	}
+
+	if vv, ok := config.Setting["interval"].(int64); ok && vv > 0 {
+		setting.Interval = time.Second * time.Duration(vv)
+	}
+	if vv, ok := config.Setting["interval"].(string); ok && vv != "" {
+		td, err := util.ParseDuration(vv)
+		if err == nil {
+			setting.Interval = td
+		}
+	}
+	if vv, ok := config.Setting["visibility"].(int64); ok && vv > 0 {
+		setting.Visibility = time.Second * time.Duration(vv)
+	}
+	if vv, ok := config.Setting["visibility"].(string); ok && vv != "" {
+		td, err := util.ParseDuration(vv)
+		if err == nil {
+			setting.Visibility = td
+		}
+	}
+
+	//重试策略，可以按队列单独配置
+	setting.Retries = kit.RetriesSetting(config.Setting, kit.Retry{Backoff: time.Second})
+
+	return &fileBusConnect{
+		name: name, config: config, setting: setting,
+		stopper: util.NewStopper(), serial: time.Now().UnixNano(),
+		events: make(map[string]kit.EnvelopeHandler, 0),
+		queues: make(map[string]fileBusQueue, 0),
+		wakes:  make(map[string]chan struct{}, 0),
+	}, nil
+}
+
+//打开连接
+func (connect *fileBusConnect) Open() error {
+	if connect.setting.Store == "" {
+		return errors.New("无效队列存储")
+	}
+	db, err := buntdb.Open(connect.setting.Store)
+	if err != nil {
+		return err
+	}
+	connect.db = db
+	return nil
+}
+func (connect *fileBusConnect) Health() (ark.BusHealth, error) {
+	return ark.BusHealth{Workload: atomic.LoadInt64(&connect.actives)}, nil
+}
+
+//关闭连接
+func (connect *fileBusConnect) Close() error {
+	connect.stopper.Stop()
+
+	if connect.db != nil {
+		if err := connect.db.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//注册回调
+func (connect *fileBusConnect) Accept(eventHandler ark.EventHandler, queueHandler ark.QueueHandler) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	connect.eventHandler = eventHandler
+	connect.queueHandler = queueHandler
+
+	return nil
+}
+
+//注册返回错误的回调，返回错误视为处理失败
+func (connect *fileBusConnect) AcceptError(eventHandler, queueHandler kit.ErrorHandler) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	connect.errorEventHandler = eventHandler
+	connect.errorQueueHandler = queueHandler
+
+	return nil
+}
+
+//注册事件
+func (connect *fileBusConnect) Event(channel string) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+	connect.events[channel] = kit.Handler(connect.envelopeEventHandler, connect.errorEventHandler, connect.eventHandler)
+	return nil
+}
+
+//注册队列
+func (connect *fileBusConnect) Queue(channel string, thread int) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	if thread <= 0 {
+		thread = 1
+	}
+	handler := kit.Handler(connect.envelopeQueueHandler, connect.errorQueueHandler, connect.queueHandler)
+	connect.queues[channel] = fileBusQueue{thread, handler, new(int64)}
+	connect.wakes[channel] = make(chan struct{}, 1)
+
+	return nil
+}
+
+//开始订阅者
+func (connect *fileBusConnect) Start() error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	//搬运到期的延时事件
+	connect.stopper.RunWorker(connect.delaying)
+	//监听队列
+	for k, v := range connect.queues {
+		name := k
+		for i := 0; i < v.Thread; i++ {
+			connect.stopper.RunWorker(func() {
+				connect.queueing(name)
+			})
+		}
+	}
+
+	connect.running = true
+	return nil
+}
+
+func (connect *fileBusConnect) Publish(name string, data []byte, delays ...time.Duration) error {
+	return connect.publish(name, data, delays...)
+}
+func (connect *fileBusConnect) Enqueue(name string, data []byte, delays ...time.Duration) error {
+	return connect.enqueue(name, data, delays...)
+}
+
+//发布，数据已经是最终写入的格式
+func (connect *fileBusConnect) publish(name string, data []byte, delays ...time.Duration) error {
+	if connect.db == nil {
+		return errors.New("连接失败")
+	}
+
+	//延时事件写入文件，到期再发
+	if len(delays) > 0 && delays[0] > 0 {
+		key := connect.config.Prefix + fileBusEventKey + connect.sequence(time.Now().Add(delays[0]))
+		return connect.write(key, fileBusValue{Name: name, Data: data})
+	}
+
+	connect.dispatch(name, data)
+	return nil
+}
+
+//入队，数据已经是最终写入的格式
+func (connect *fileBusConnect) enqueue(name string, data []byte, delays ...time.Duration) error {
+	if connect.db == nil {
+		return errors.New("连接失败")
+	}
+
+	due := time.Now()
+	if len(delays) > 0 && delays[0] > 0 {
+		due = due.Add(delays[0])
+	}
+
+	key := connect.queueKey(name) + connect.sequence(due)
+	if err := connect.write(key, fileBusValue{Name: name, Data: data}); err != nil {
+		return err
+	}
+
+	connect.wakeup(name)
+	return nil
+}
+
+//到期时间加序号，定长保证按key排序即按时间排序
+func (connect *fileBusConnect) sequence(due time.Time) string {
+	return fmt.Sprintf("%020d:%020d", due.UnixNano(), atomic.AddInt64(&connect.serial, 1))
+}
+
+//从key中解析到期时间
+func (connect *fileBusConnect) due(key string) (time.Time, bool) {
+	if len(key) < 41 || key[len(key)-21] != ':' {
+		return time.Time{}, false
+	}
+	seq := key[len(key)-41:]
+	nano, err := strconv.ParseInt(seq[:20], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nano), true
+}
+
+func (connect *fileBusConnect) queueKey(name string) string {
+	return connect.config.Prefix + fileBusQueueKey + name + ":"
+}
+
+func (connect *fileBusConnect) write(key string, value fileBusValue) error {
+	bytes, err := ark.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return connect.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(key, string(bytes), nil)
+		return err
+	})
+}
+
+//事件只在本进程内分发
+func (connect *fileBusConnect) dispatch(name string, data []byte) {
+	connect.mutex.RLock()
+	call, ok := connect.events[name]
+	connect.mutex.RUnlock()
+
+	if ok {
+		go func() {
+			//事件不重试，失败了只记录
+			envelope := kit.DecodeEnvelope(data)
+			if err := kit.Safe(func() error { return call(name, envelope) }); err != nil {
+				ark.Warning("bus.file.event", name, err)
+			}
+		}()
+	}
+}
+
+//唤醒队列消费者
+func (connect *fileBusConnect) wakeup(name string) {
+	connect.mutex.RLock()
+	wake, ok := connect.wakes[name]
+	connect.mutex.RUnlock()
+
+	if ok {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//定时发出到期的延时事件
+func (connect *fileBusConnect) delaying() {
+	ticker := time.NewTicker(connect.setting.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			connect.delayed()
+		case <-connect.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+func (connect *fileBusConnect) delayed() {
+	now := time.Now()
+	values := []fileBusValue{}
+
+	err := connect.db.Update(func(tx *buntdb.Tx) error {
+		keys := []string{}
+		tx.AscendKeys(connect.config.Prefix+fileBusEventKey+"*", func(k, v string) bool {
+			due, ok := connect.due(k)
+			if ok && due.After(now) {
+				return false
+			}
+			keys = append(keys, k)
+
+			value := fileBusValue{}
+			if err := ark.Unmarshal([]byte(v), &value); err == nil {
+				values = append(values, value)
+			}
+			return true
+		})
+		for _, key := range keys {
+			if _, err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		ark.Warning("bus.file.delayed", err)
+		return
+	}
+
+	for _, value := range values {
+		connect.dispatch(value.Name, value.Data)
+	}
+}
+
+//队列监听
+func (connect *fileBusConnect) queueing(name string) {
+	wake := connect.wakes[name]
+
+	for {
+		select {
+		case <-connect.stopper.ShouldStop():
+			return
+		default:
+		}
+
+		//有消息就接着处理，没有就等通知或是轮询
+		if connect.dequeue(name) {
+			continue
+		}
+
+		select {
+		case <-wake:
+		case <-time.After(connect.setting.Interval):
+		case <-connect.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+//取一条到期的消息处理
+//取出时把到期时间推后visibility，处理完才删除，进程中途退出的消息重启后会再次投递
+func (connect *fileBusConnect) dequeue(name string) bool {
+	call, ok := connect.queues[name]
+	if ok == false {
+		return false
+	}
+
+	now := time.Now()
+	prefix := connect.queueKey(name)
+	old, key, value := "", "", fileBusValue{}
+
+	err := connect.db.Update(func(tx *buntdb.Tx) error {
+		val := ""
+		tx.AscendKeys(prefix+"*", func(k, v string) bool {
+			due, ok := connect.due(k)
+			if ok == false || len(k) != len(prefix)+41 {
+				return true //其它队列的key，名称里有冒号
+			}
+			if due.Before(now) || due.Equal(now) {
+				old, val = k, v
+			}
+			return false
+		})
+		if old == "" {
+			return nil
+		}
+		if _, err := tx.Delete(old); err != nil {
+			return err
+		}
+		if err := ark.Unmarshal([]byte(val), &value); err != nil {
+			ark.Warning("bus.file.dequeue", old, err)
+			return nil //无效消息直接删除
+		}
+
+		key = prefix + connect.sequence(now.Add(connect.setting.Visibility))
+		_, _, err := tx.Set(key, val, nil)
+		return err
+	})
+	if err != nil {
+		ark.Warning("bus.file.dequeue", err)
+		return false
+	}
+	if key == "" {
+		return old != ""
+	}
+
+	envelope := kit.DecodeEnvelope(value.Data)
+	envelope.Attempt = value.Attempt
+	err = kit.Handle(func() error {
+		return call.Handler(name, envelope)
+	}, &connect.actives, call.Actives)
+
+	failed := err != nil
+
+	//完成删除，失败按策略重试或转入死信
+	next := ""
+	err = connect.db.Update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Delete(key); err != nil {
+			if err == buntdb.ErrNotFound {
+				return nil //处理超时，已经被重新投递了
+			}
+			return err
+		}
+		if failed == false {
+			return nil
+		}
+
+		retry := connect.setting.Retries.Queue(name)
+		value.Attempt++
+		if value.Attempt <= retry.Retry {
+			next = prefix + connect.sequence(time.Now().Add(retry.Delay(value.Attempt)))
+		} else if retry.Deadletter != "" {
+			value.Name = retry.Deadletter
+			next = connect.queueKey(retry.Deadletter) + connect.sequence(time.Now())
+		} else {
+			ark.Warning("bus.file.dropped", name, value.Attempt)
+			return nil
+		}
+
+		bytes, err := ark.Marshal(value)
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set(next, string(bytes), nil)
+		return err
+	})
+	if err != nil {
+		ark.Warning("bus.file.dequeue", err)
+	}
+	if next != "" && value.Name != name {
+		connect.wakeup(value.Name)
+	}
+
+	return true
+}
+
+//-------------------- fileBus end -------------------------
@@ -0,0 +1,81 @@
+package bus
+
+import (
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arkgo/ark"
+	. "github.com/arkgo/asset"
+	"github.com/arkgo/driver/kit"
+)
+
+func testFileBus(t *testing.T, setting Map) *fileBusConnect {
+	setting["file"] = filepath.Join(t.TempDir(), "bus.db")
+	connect, err := Driver().Connect("test", ark.BusConfig{Setting: setting})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connect.Close() })
+	return connect.(*fileBusConnect)
+}
+
+func TestFileBusEnvelope(t *testing.T) {
+	connect := testFileBus(t, Map{"interval": "10ms"})
+
+	got := make(chan kit.Envelope, 1)
+	connect.AcceptEnvelope(nil, func(name string, envelope kit.Envelope) error {
+		got <- envelope
+		return nil
+	})
+	connect.Queue("work", 1)
+	connect.Start()
+
+	if err := connect.EnqueueEnvelope("work", kit.Envelope{Id: "m1", Headers: map[string]string{"a": "b"}, Data: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case envelope := <-got:
+		if envelope.Id != "m1" || envelope.Headers["a"] != "b" || string(envelope.Data) != "hello" {
+			t.Errorf("got %+v", envelope)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not delivered")
+	}
+}
+
+func TestFileBusErrorHandler(t *testing.T) {
+	connect := testFileBus(t, Map{"interval": "10ms", "retry": int64(2), "backoff": "1ms", "deadletter": "dead"})
+
+	attempts := int64(0)
+	connect.AcceptError(nil, func(name string, data []byte) error {
+		atomic.AddInt64(&attempts, 1)
+		return errors.New("failed")
+	})
+	connect.Queue("work", 1)
+	connect.Start()
+
+	connect.Enqueue("work", []byte("hello"))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats, err := connect.Inspect("work")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats[0].Deadletter == 1 && stats[0].Length == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %+v", stats[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt64(&attempts); got != 3 {
+		t.Errorf("got %d attempts, want 3", got)
+	}
+}
@@ -0,0 +1,18 @@
+package bus
+
+import (
+	"github.com/arkgo/ark"
+)
+
+func Driver(ss ...string) ark.BusDriver {
+	store := ""
+	if len(ss) > 0 {
+		store = ss[0]
+	}
+	return &fileBusDriver{store}
+}
+
+func init() {
+	ark.Register("buntdb", Driver("store/bus.db"))
+	ark.Register("file", Driver("store/bus.db"))
+}
@@ -0,0 +1,81 @@
+package bus
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/arkgo/driver/kit"
+	"github.com/tidwall/buntdb"
+)
+
+//------------------------- 队列查看 begin --------------------------
+//排队数包括处理中还没删除的消息，它们的到期时间被推后了visibility
+
+//查看队列，不指定就是本连接注册的全部队列
+func (connect *fileBusConnect) Inspect(names ...string) ([]kit.QueueStats, error) {
+	if connect.db == nil {
+		return nil, errors.New("连接失败")
+	}
+
+	connect.mutex.RLock()
+	if len(names) == 0 {
+		for name, _ := range connect.queues {
+			names = append(names, name)
+		}
+	}
+	queues := make(map[string]fileBusQueue, len(names))
+	for _, name := range names {
+		if queue, ok := connect.queues[name]; ok {
+			queues[name] = queue
+		}
+	}
+	connect.mutex.RUnlock()
+	sort.Strings(names)
+
+	stats := make([]kit.QueueStats, 0, len(names))
+	err := connect.db.View(func(tx *buntdb.Tx) error {
+		now := time.Now()
+		for _, name := range names {
+			stat := kit.QueueStats{Name: name}
+			if queue, ok := queues[name]; ok {
+				stat.Workers = queue.Thread
+				stat.Actives = atomic.LoadInt64(queue.Actives)
+			}
+			stat.Length, stat.Oldest = connect.inspect(tx, name, now)
+			if retry := connect.setting.Retries.Queue(name); retry.Deadletter != "" {
+				stat.Deadletter, _ = connect.inspect(tx, retry.Deadletter, now)
+			}
+			stats = append(stats, stat)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+//排队数，和已到期的最早消息等了多久
+func (connect *fileBusConnect) inspect(tx *buntdb.Tx, name string, now time.Time) (int64, time.Duration) {
+	prefix := connect.queueKey(name)
+	length, oldest := int64(0), time.Duration(0)
+
+	tx.AscendKeys(prefix+"*", func(k, v string) bool {
+		due, ok := connect.due(k)
+		if ok == false || len(k) != len(prefix)+41 {
+			return true //其它队列的key，名称里有冒号
+		}
+		if length == 0 && due.Before(now) {
+			oldest = now.Sub(due)
+		}
+		length++
+		return true
+	})
+
+	return length, oldest
+}
+
+//------------------------- 队列查看 end --------------------------
@@ -1,14 +1,26 @@
 package bus
 
 import (
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/arkgo/ark"
+	"github.com/arkgo/asset/util"
+	"github.com/arkgo/driver/kit"
 )
 
 //------------------------- 默认队列驱动 begin --------------------------
 
+//支持的扩展
+var (
+	_ kit.EnvelopeBus = (*defaultBusConnect)(nil)
+	_ kit.ErrorBus    = (*defaultBusConnect)(nil)
+	_ kit.RequestBus  = (*defaultBusConnect)(nil)
+	_ kit.ScheduleBus = (*defaultBusConnect)(nil)
+	_ kit.InspectBus  = (*defaultBusConnect)(nil)
+)
+
 type (
 	defaultBusDriver  struct{}
 	defaultBusConnect struct {
@@ -16,18 +28,79 @@ type (
 		running bool
 		actives int64
 
-		name   string
-		config ark.BusConfig
+		name    string
+		config  ark.BusConfig
+		setting defaultBusSetting
 
 		eventHandler ark.EventHandler
 		queueHandler ark.QueueHandler
+
+		errorEventHandler kit.ErrorHandler
+		errorQueueHandler kit.ErrorHandler
+
+		envelopeEventHandler kit.EnvelopeHandler
+		envelopeQueueHandler kit.EnvelopeHandler
+
+		bus    *defaultBus
+		queues []string
+	}
+	defaultBusSetting struct {
+		Drain   time.Duration //关闭时等待处理中消息的最长时间
+		Buffer  defaultBusBuffer
+		Retries kit.Retries   //重试策略，可以按队列单独配置
+		Dedup   time.Duration //去重窗口，窗口内相同编号的队列消息只处理一次，0为不去重
+	}
+	//队列缓冲
+	defaultBusBuffer struct {
+		Depth      int    //最大排队数，每个分区单独计算
+		Policy     string //队列满了的策略，block、drop、reject
+		Partitions int    //带分区键的消息分到多少个分区，0为不分区，不保证顺序
 	}
 )
 
 //连接
 func (driver *defaultBusDriver) Connect(name string, config ark.BusConfig) (ark.BusConnect, error) {
+	setting := defaultBusSetting{
+		Drain:  time.Second * 10,
+		Buffer: defaultBusBuffer{Depth: 1000, Policy: defaultBusPolicyBlock, Partitions: 16},
+	}
+
+	if vv, ok := config.Setting["drain"].(int64); ok && vv > 0 {
+		setting.Drain = time.Second * time.Duration(vv)
+	}
+	if vv, ok := config.Setting["drain"].(string); ok && vv != "" {
+		td, err := util.ParseDuration(vv)
+		if err == nil {
+			setting.Drain = td
+		}
+	}
+
+	if vv, ok := config.Setting["depth"].(int64); ok && vv > 0 {
+		setting.Buffer.Depth = int(vv)
+	}
+	if vv, ok := config.Setting["policy"].(string); ok && vv != "" {
+		setting.Buffer.Policy = strings.ToLower(vv)
+	}
+	if vv, ok := config.Setting["partitions"].(int64); ok && vv >= 0 {
+		setting.Buffer.Partitions = int(vv)
+	}
+
+	//重试策略，可以按队列单独配置
+	setting.Retries = kit.RetriesSetting(config.Setting, kit.Retry{Backoff: time.Second})
+
+	if vv, ok := config.Setting["dedup"].(int64); ok && vv > 0 {
+		setting.Dedup = time.Second * time.Duration(vv)
+	}
+	if vv, ok := config.Setting["dedup"].(string); ok && vv != "" {
+		td, err := util.ParseDuration(vv)
+		if err == nil {
+			setting.Dedup = td
+		}
+	}
+
 	return &defaultBusConnect{
-		name: name, config: config,
+		name: name, config: config, setting: setting,
+		bus: newDefaultBus(setting.Dedup),
 	}, nil
 }
 
@@ -38,12 +111,15 @@ func (connect *defaultBusConnect) Open() error {
 func (connect *defaultBusConnect) Health() (ark.BusHealth, error) {
 	connect.mutex.RLock()
 	defer connect.mutex.RUnlock()
-	return ark.BusHealth{Workload: connect.actives}, nil
+	return ark.BusHealth{Workload: connect.bus.Workload(connect.queues...)}, nil
 }
 
 //关闭连接
+//不再接收新消息，等处理中的消息完成，最多等待drain
 func (connect *defaultBusConnect) Close() error {
-	bus.stopper.Stop()
+	if connect.bus.Close(connect.setting.Drain) == false {
+		ark.Warning("bus.default.drain", connect.name, "timeout")
+	}
 	return nil
 }
 
@@ -57,14 +133,48 @@ func (connect *defaultBusConnect) Accept(eventHandler ark.EventHandler, queueHan
 	return nil
 }
 
+//注册返回错误的回调，返回错误视为处理失败
+func (connect *defaultBusConnect) AcceptError(eventHandler, queueHandler kit.ErrorHandler) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	connect.errorEventHandler = eventHandler
+	connect.errorQueueHandler = queueHandler
+
+	return nil
+}
+
 func (connect *defaultBusConnect) Event(channel string) error {
-	return bus.Event(channel, connect.eventHandler)
+	connect.mutex.RLock()
+	handler := kit.Handler(connect.envelopeEventHandler, connect.errorEventHandler, connect.eventHandler)
+	connect.mutex.RUnlock()
+	return connect.bus.Event(channel, handler)
 }
 func (connect *defaultBusConnect) Queue(channel string, thread int) error {
 	if thread <= 0 {
 		thread = 1
 	}
-	return bus.Queue(channel, thread, connect.queueHandler)
+	retry := connect.setting.Retries.Queue(channel)
+
+	connect.mutex.Lock()
+	connect.queues = append(connect.queues, channel)
+	handler := kit.Handler(connect.envelopeQueueHandler, connect.errorQueueHandler, connect.queueHandler)
+	connect.mutex.Unlock()
+
+	return connect.bus.Queue(channel, thread, handler, retry, connect.setting.Buffer)
+}
+
+//注册应答
+func (connect *defaultBusConnect) Respond(name string, thread int, handler kit.RespondHandler) error {
+	if thread <= 0 {
+		thread = 1
+	}
+	return connect.bus.Respond(name, thread, handler)
+}
+
+//发起请求，等待应答
+func (connect *defaultBusConnect) Request(name string, data []byte, timeout time.Duration) ([]byte, error) {
+	return connect.bus.Request(name, data, timeout)
 }
 
 //开始订阅者
@@ -77,24 +187,10 @@ func (connect *defaultBusConnect) Start() error {
 }
 
 func (connect *defaultBusConnect) Publish(name string, data []byte, delays ...time.Duration) error {
-	if len(delays) > 0 {
-		time.AfterFunc(delays[0], func() {
-			bus.Publish(name, data)
-		})
-	} else {
-		return bus.Publish(name, data)
-	}
-	return nil
+	return connect.PublishEnvelope(name, kit.Envelope{Data: data}, delays...)
 }
 func (connect *defaultBusConnect) Enqueue(name string, data []byte, delays ...time.Duration) error {
-	if len(delays) > 0 {
-		time.AfterFunc(delays[0], func() {
-			bus.Enqueue(name, data)
-		})
-	} else {
-		return bus.Enqueue(name, data)
-	}
-	return nil
+	return connect.EnqueueEnvelope(name, kit.Envelope{Data: data}, delays...)
 }
 
 //执行统一到这里
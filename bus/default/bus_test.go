@@ -0,0 +1,309 @@
+package bus
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arkgo/ark"
+	. "github.com/arkgo/asset"
+	"github.com/arkgo/driver/kit"
+)
+
+func testDefaultBus(t *testing.T, setting Map) *defaultBusConnect {
+	driver := &defaultBusDriver{}
+	connect, err := driver.Connect("test", ark.BusConfig{Setting: setting})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connect.Close() })
+	return connect.(*defaultBusConnect)
+}
+
+func TestDefaultBusErrorHandler(t *testing.T) {
+	connect := testDefaultBus(t, Map{"retry": int64(2), "backoff": "1ms", "deadletter": "dead"})
+
+	attempts := int64(0)
+	dead := make(chan []byte, 1)
+	connect.AcceptError(nil, func(name string, data []byte) error {
+		if name == "dead" {
+			dead <- data
+			return nil
+		}
+		atomic.AddInt64(&attempts, 1)
+		return errors.New("failed")
+	})
+	connect.Queue("work", 1)
+	connect.Queue("dead", 1)
+	connect.Start()
+
+	if err := connect.Enqueue("work", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-dead:
+		if string(data) != "hello" {
+			t.Errorf("got %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not dead lettered")
+	}
+	if got := atomic.LoadInt64(&attempts); got != 3 {
+		t.Errorf("got %d attempts, want 3", got)
+	}
+}
+
+func TestDefaultBusPlainHandler(t *testing.T) {
+	connect := testDefaultBus(t, Map{"retry": int64(2), "backoff": "1ms"})
+
+	attempts := int64(0)
+	connect.Accept(nil, func(name string, data []byte) {
+		atomic.AddInt64(&attempts, 1)
+	})
+	connect.Queue("work", 1)
+	connect.Start()
+
+	connect.Enqueue("work", []byte("hello"))
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt64(&attempts); got != 1 {
+		t.Errorf("got %d attempts, want 1", got)
+	}
+}
+
+//在限定时间内完成，否则当作卡住了
+func testDefaultBusWithin(t *testing.T, timeout time.Duration, call func()) {
+	done := make(chan struct{})
+	go func() {
+		call()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("blocked")
+	}
+}
+
+func TestDefaultBusNoConsumerNotBlock(t *testing.T) {
+	connect := testDefaultBus(t, Map{"depth": int64(10)})
+
+	testDefaultBusWithin(t, time.Second, func() {
+		for i := 0; i < 100; i++ {
+			if err := connect.Enqueue("idle", []byte("x")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	})
+	if stat := connect.bus.Inspect("idle"); stat.Length != 10 {
+		t.Errorf("got length %d, want 10", stat.Length)
+	}
+}
+
+func TestDefaultBusDeadletterNotBlock(t *testing.T) {
+	connect := testDefaultBus(t, Map{"deadletter": "dead"})
+
+	total := int64(0)
+	connect.AcceptError(nil, func(name string, data []byte) error {
+		atomic.AddInt64(&total, 1)
+		return errors.New("failed")
+	})
+	connect.Queue("work", 4)
+	connect.Start()
+
+	//死信队列没有消费者，超过默认深度也不能卡住处理线程
+	count := int64(1500)
+	for i := int64(0); i < count; i++ {
+		connect.Enqueue("work", []byte("x"))
+	}
+	testDefaultBusWithin(t, 5*time.Second, func() {
+		for atomic.LoadInt64(&total) < count {
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+func TestDefaultBusPatternEvent(t *testing.T) {
+	connect := testDefaultBus(t, Map{})
+
+	got := make(chan string, 4)
+	connect.Accept(func(name string, data []byte) {
+		got <- name
+	}, nil)
+	if err := connect.Event("order.*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Event("order.[ab"); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+	connect.Start()
+
+	connect.Publish("order.created.v2", []byte("x"))
+	connect.Publish("user.created", []byte("x"))
+	select {
+	case name := <-got:
+		if name != "order.created.v2" {
+			t.Errorf("got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not delivered")
+	}
+	select {
+	case name := <-got:
+		t.Errorf("unexpected %s", name)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestDefaultBusRequestTimeout(t *testing.T) {
+	connect := testDefaultBus(t, Map{})
+	connect.Respond("echo", 1, func(name string, data []byte) ([]byte, error) {
+		return data, nil
+	})
+
+	if _, err := connect.Request("echo", []byte("x"), 0); err != kit.ErrInvalidTimeout {
+		t.Errorf("got %v", err)
+	}
+	data, err := connect.Request("echo", []byte("x"), 200*time.Millisecond)
+	if err != nil || string(data) != "x" {
+		t.Errorf("got %q %v", data, err)
+	}
+}
+
+func TestDefaultBusRespondPanic(t *testing.T) {
+	connect := testDefaultBus(t, Map{})
+	connect.Respond("boom", 1, func(name string, data []byte) ([]byte, error) {
+		panic("boom")
+	})
+
+	//panic视为失败，应答的协程还在
+	for i := 0; i < 2; i++ {
+		if _, err := connect.Request("boom", []byte("x"), 200*time.Millisecond); err == nil || err.Error() != "boom" {
+			t.Errorf("got %v", err)
+		}
+	}
+}
+
+func TestDefaultBusDedupRetry(t *testing.T) {
+	connect := testDefaultBus(t, Map{"dedup": "1m", "retry": int64(2), "backoff": "1ms"})
+
+	attempts := int64(0)
+	done := make(chan struct{}, 4)
+	connect.AcceptError(nil, func(name string, data []byte) error {
+		//第一次失败，重试成功
+		if atomic.AddInt64(&attempts, 1) == 1 {
+			return errors.New("failed")
+		}
+		done <- struct{}{}
+		return nil
+	})
+	connect.Queue("work", 1)
+	connect.Start()
+
+	connect.EnqueueEnvelope("work", kit.Envelope{Id: "m1", Data: []byte("x")})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("retry was deduplicated")
+	}
+
+	//成功之后相同编号的跳过
+	connect.EnqueueEnvelope("work", kit.Envelope{Id: "m1", Data: []byte("x")})
+	select {
+	case <-done:
+		t.Error("duplicate processed")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDefaultBusDedupFailure(t *testing.T) {
+	connect := testDefaultBus(t, Map{"dedup": "1m"})
+
+	attempts := int64(0)
+	connect.AcceptError(nil, func(name string, data []byte) error {
+		atomic.AddInt64(&attempts, 1)
+		return errors.New("failed")
+	})
+	connect.Queue("work", 1)
+	connect.Start()
+
+	//彻底失败了，生产者重发的还要处理
+	connect.EnqueueEnvelope("work", kit.Envelope{Id: "m1", Data: []byte("x")})
+	time.Sleep(20 * time.Millisecond)
+	connect.EnqueueEnvelope("work", kit.Envelope{Id: "m1", Data: []byte("x")})
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt64(&attempts); got != 2 {
+		t.Errorf("got %d attempts, want 2", got)
+	}
+}
+
+func TestDefaultBusDedupGeneratedId(t *testing.T) {
+	connect := testDefaultBus(t, Map{"dedup": "1m"})
+
+	done := make(chan struct{}, 4)
+	connect.Accept(nil, func(name string, data []byte) {
+		done <- struct{}{}
+	})
+	connect.Queue("work", 1)
+	connect.Start()
+
+	//没有指定编号的不记去重
+	connect.Enqueue("work", []byte("x"))
+	connect.Enqueue("work", []byte("x"))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("message not processed")
+		}
+	}
+	connect.bus.mutex.Lock()
+	defer connect.bus.mutex.Unlock()
+	if len(connect.bus.dedups) != 0 {
+		t.Errorf("generated ids deduplicated: %v", connect.bus.dedups)
+	}
+}
+
+func TestDefaultBusKeyOrder(t *testing.T) {
+	connect := testDefaultBus(t, Map{})
+
+	keys, count := 5, 200
+	mutex := make(chan struct{}, 1)
+	got := make(map[string][]int, 0)
+	done := make(chan struct{})
+	total := 0
+	connect.AcceptEnvelope(nil, func(name string, envelope kit.Envelope) error {
+		mutex <- struct{}{}
+		got[envelope.Key] = append(got[envelope.Key], int(envelope.Data[0])<<8|int(envelope.Data[1]))
+		total++
+		if total == keys*count {
+			close(done)
+		}
+		<-mutex
+		return nil
+	})
+	connect.Queue("work", 8)
+	connect.Start()
+
+	for i := 0; i < count; i++ {
+		for k := 0; k < keys; k++ {
+			key := string(rune('a' + k))
+			connect.EnqueueEnvelope("work", kit.Envelope{Key: key, Data: []byte{byte(i >> 8), byte(i)}})
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not all processed")
+	}
+	for key, values := range got {
+		for i, value := range values {
+			if value != i {
+				t.Fatalf("key %s: got %d at %d", key, value, i)
+			}
+		}
+	}
+}
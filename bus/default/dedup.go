@@ -0,0 +1,91 @@
+package bus
+
+import (
+	"time"
+
+	"github.com/arkgo/driver/kit"
+)
+
+//------------------------- 消息去重 begin --------------------------
+//按信封编号去重，只对生产者指定了编号的消息去重，自动生成的编号每条都不一样，不用去重
+//分两个状态
+//处理前占位为处理中，处理成功才改为已完成，保留去重窗口的时长
+//失败了删除占位，重试或生产者重发的还能处理
+//已完成或处理中的相同编号直接跳过
+
+type (
+	defaultBusDedup struct {
+		Done   bool
+		Expiry time.Time //已完成的过期时间
+	}
+)
+
+func (bus *defaultBus) dedupable(envelope kit.Envelope) bool {
+	return bus.dedup > 0 && envelope.Dedup && envelope.Id != ""
+}
+
+//是否重复的消息，不重复就占位
+func (bus *defaultBus) duplicated(channel string, envelope kit.Envelope) bool {
+	if bus.dedupable(envelope) == false {
+		return false
+	}
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	key := channel + ":" + envelope.Id
+	if dedup, ok := bus.dedups[key]; ok && (dedup.Done == false || time.Now().Before(dedup.Expiry)) {
+		return true
+	}
+	bus.dedups[key] = defaultBusDedup{}
+	return false
+}
+
+//处理成功，去重窗口内不再处理
+func (bus *defaultBus) dedupDone(channel string, envelope kit.Envelope) {
+	if bus.dedupable(envelope) == false {
+		return
+	}
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.dedups[channel+":"+envelope.Id] = defaultBusDedup{Done: true, Expiry: time.Now().Add(bus.dedup)}
+}
+
+//处理失败，取消占位
+func (bus *defaultBus) undedup(channel string, envelope kit.Envelope) {
+	if bus.dedupable(envelope) == false {
+		return
+	}
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	delete(bus.dedups, channel+":"+envelope.Id)
+}
+
+//定时清理过期的去重记录，处理中的不清理
+func (bus *defaultBus) sweeping() {
+	interval := bus.dedup
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			bus.mutex.Lock()
+			for key, dedup := range bus.dedups {
+				if dedup.Done && now.After(dedup.Expiry) {
+					delete(bus.dedups, key)
+				}
+			}
+			bus.mutex.Unlock()
+		case <-bus.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+//------------------------- 消息去重 end --------------------------
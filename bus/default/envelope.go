@@ -0,0 +1,53 @@
+package bus
+
+import (
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/arkgo/driver/kit"
+)
+
+//------------------------- 消息信封 begin --------------------------
+//发布和入队的消息都包在信封里，带上编号、头信息、重试次数和入队时间
+//内存里直接传结构，不用序列化
+
+//注册带信封的回调，注册后处理器拿到完整信封，返回错误视为处理失败
+func (connect *defaultBusConnect) AcceptEnvelope(eventHandler, queueHandler kit.EnvelopeHandler) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	connect.envelopeEventHandler = eventHandler
+	connect.envelopeQueueHandler = queueHandler
+
+	return nil
+}
+
+//发布带信封的消息，编号和时间为空时自动生成
+func (connect *defaultBusConnect) PublishEnvelope(name string, envelope kit.Envelope, delays ...time.Duration) error {
+	envelope = kit.SealEnvelope(envelope)
+	if len(delays) > 0 {
+		time.AfterFunc(delays[0], func() {
+			connect.bus.Publish(name, envelope)
+		})
+	} else {
+		return connect.bus.Publish(name, envelope)
+	}
+	return nil
+}
+
+//入队带信封的消息，编号和时间为空时自动生成
+func (connect *defaultBusConnect) EnqueueEnvelope(name string, envelope kit.Envelope, delays ...time.Duration) error {
+	envelope = kit.SealEnvelope(envelope)
+	if len(delays) > 0 {
+		time.AfterFunc(delays[0], func() {
+			if err := connect.bus.Enqueue(name, envelope, connect.setting.Buffer); err != nil {
+				ark.Warning("bus.default.enqueue", name, err)
+			}
+		})
+	} else {
+		return connect.bus.Enqueue(name, envelope, connect.setting.Buffer)
+	}
+	return nil
+}
+
+//------------------------- 消息信封 end --------------------------
@@ -0,0 +1,58 @@
+package bus
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/arkgo/driver/kit"
+)
+
+//------------------------- 队列查看 begin --------------------------
+
+//查看队列，不指定就是本连接注册的全部队列
+func (connect *defaultBusConnect) Inspect(names ...string) ([]kit.QueueStats, error) {
+	if len(names) == 0 {
+		connect.mutex.RLock()
+		names = append(names, connect.queues...)
+		connect.mutex.RUnlock()
+	}
+	sort.Strings(names)
+
+	stats := make([]kit.QueueStats, 0, len(names))
+	for _, name := range names {
+		stat := connect.bus.Inspect(name)
+
+		if retry := connect.setting.Retries.Queue(name); retry.Deadletter != "" {
+			stat.Deadletter = connect.bus.Inspect(retry.Deadletter).Length
+		}
+
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+//查看一个队列
+func (bus *defaultBus) Inspect(channel string) kit.QueueStats {
+	stat := kit.QueueStats{Name: channel}
+
+	bus.mutex.Lock()
+	queue, ok := bus.queues[channel]
+	bus.mutex.Unlock()
+	if ok == false {
+		return stat
+	}
+
+	stat.Workers = int(atomic.LoadInt64(&queue.workers))
+	stat.Actives = atomic.LoadInt64(&queue.actives)
+	for _, lane := range queue.lanes() {
+		stat.Length += int64(len(lane.values))
+		if oldest := lane.oldest(); oldest > stat.Oldest {
+			stat.Oldest = oldest
+		}
+	}
+
+	return stat
+}
+
+//------------------------- 队列查看 end --------------------------
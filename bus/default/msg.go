@@ -1,40 +1,106 @@
 package bus
 
 import (
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/arkgo/ark"
 	. "github.com/arkgo/asset"
 	"github.com/arkgo/asset/util"
+	"github.com/arkgo/driver/kit"
 )
 
 //------------------------- 默认队列驱动 begin --------------------------
 
 type (
 	defaultBus struct {
-		mutex   sync.Mutex
-		stopper *util.Stopper
-		events  map[string][]ark.EventHandler
-		queues  map[string]chan []byte
+		mutex    sync.Mutex
+		closed   bool
+		stopper  *util.Stopper
+		waiter   sync.WaitGroup //处理中的事件
+		events   map[string][]kit.EnvelopeHandler
+		queues   map[string]*defaultBusQueue
+		requests map[string]chan defaultBusRequest
+
+		dedup  time.Duration
+		dedups map[string]defaultBusDedup //去重的消息
+	}
+	defaultBusFunc  func(string, Map)
+	defaultBusQueue struct {
+		main    *defaultBusLane   //没有分区键的消息，多个线程一起处理
+		shards  []*defaultBusLane //带分区键的消息按键分到固定分区，每个分区一个线程
+		policy  string
+		actives int64 //处理中的数量
+		workers int64 //处理线程
+
+		mutex       sync.Mutex
+		partitioned bool //分区线程是否已经开始
 	}
-	defaultBusFunc func(string, Map)
+	defaultBusLane struct {
+		values chan kit.Envelope
+
+		mutex sync.Mutex
+		times []time.Time //排队消息的入队时间，和values顺序一致，用来算最早消息等了多久
+	}
+)
+
+const (
+	defaultBusPolicyBlock  = "block"  //队列满了等待，没有消费者时丢弃最早的
+	defaultBusPolicyDrop   = "drop"   //队列满了丢弃最早的消息
+	defaultBusPolicyReject = "reject" //队列满了返回错误
 )
 
 var (
-	bus *defaultBus
+	errDefaultBusFull   = errors.New("队列已满")
+	errDefaultBusClosed = errors.New("队列已关闭")
 )
 
-func init() {
-	bus = &defaultBus{stopper: util.NewStopper(), events: make(map[string][]ark.EventHandler, 0), queues: make(map[string]chan []byte, 0)}
+func newDefaultBus(dedup time.Duration) *defaultBus {
+	bus := &defaultBus{stopper: util.NewStopper(), events: make(map[string][]kit.EnvelopeHandler, 0), queues: make(map[string]*defaultBusQueue, 0), requests: make(map[string]chan defaultBusRequest, 0)}
+	bus.dedup, bus.dedups = dedup, make(map[string]defaultBusDedup, 0)
+	if dedup > 0 {
+		bus.stopper.RunWorker(bus.sweeping)
+	}
+	return bus
+}
+
+//关闭，不再接收新消息，等待处理中的完成
+//超过drain还没完成返回false
+func (bus *defaultBus) Close(drain time.Duration) bool {
+	bus.mutex.Lock()
+	bus.closed = true
+	bus.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		bus.stopper.Stop()
+		bus.waiter.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(drain):
+		return false
+	}
 }
 
 //订阅事件
-func (bus *defaultBus) Event(channel string, handler ark.EventHandler) error {
+func (bus *defaultBus) Event(channel string, handler kit.EnvelopeHandler) error {
+	if kit.Pattern(channel) {
+		if err := kit.ValidPattern(channel); err != nil {
+			return err
+		}
+	}
+
 	bus.mutex.Lock()
 	defer bus.mutex.Unlock()
 
 	if _, ok := bus.events[channel]; ok == false {
-		bus.events[channel] = make([]ark.EventHandler, 0)
+		bus.events[channel] = make([]kit.EnvelopeHandler, 0)
 	}
 
 	//加入调用列表
@@ -44,23 +110,20 @@ func (bus *defaultBus) Event(channel string, handler ark.EventHandler) error {
 }
 
 //订阅队列
-func (bus *defaultBus) Queue(channel string, thread int, handler ark.QueueHandler) error {
-	bus.mutex.Lock()
-	defer bus.mutex.Unlock()
-
-	if _, ok := bus.queues[channel]; ok == false {
-		bus.queues[channel] = make(chan []byte)
-	}
-
-	var queue = bus.queues[channel]
+func (bus *defaultBus) Queue(channel string, thread int, handler kit.EnvelopeHandler, retry kit.Retry, buffer defaultBusBuffer) error {
+	var queue = bus.queue(channel, buffer)
+	atomic.AddInt64(&queue.workers, int64(thread))
 
 	//开5线程
 	for i := 0; i < thread; i++ {
 		bus.stopper.RunWorker(func() {
 			for {
 				select {
-				case value := <-queue:
-					handler(channel, value)
+				case value := <-queue.main.values:
+					queue.main.dequeued()
+					atomic.AddInt64(&queue.actives, 1)
+					bus.handle(channel, value, handler, retry, buffer)
+					atomic.AddInt64(&queue.actives, -1)
 				case <-bus.stopper.ShouldStop():
 					return
 				}
@@ -68,36 +131,245 @@ func (bus *defaultBus) Queue(channel string, thread int, handler ark.QueueHandle
 		})
 	}
 
+	//分区线程只开一次
+	queue.mutex.Lock()
+	partitioned := queue.partitioned
+	queue.partitioned = true
+	queue.mutex.Unlock()
+	if partitioned == false {
+		bus.partitioning(channel, queue, handler, retry, buffer)
+	}
+
 	return nil
 }
 
 //发布消息，可以N多线程，
-func (busMsg *defaultBus) Publish(channel string, data []byte) error {
+func (bus *defaultBus) Publish(channel string, envelope kit.Envelope) error {
 	bus.mutex.Lock()
 	defer bus.mutex.Unlock()
 
-	if calls, ok := bus.events[channel]; ok {
-		for _, call := range calls {
-			go call(channel, data)
+	if bus.closed {
+		return errDefaultBusClosed
+	}
+
+	//精确订阅加上匹配的通配订阅，如 order.*
+	calls := []kit.EnvelopeHandler{}
+	for name, handlers := range bus.events {
+		if name == channel {
+			calls = append(calls, handlers...)
+		} else if kit.Pattern(name) && kit.Match(name, channel) {
+			calls = append(calls, handlers...)
 		}
 	}
 
+	for _, call := range calls {
+		bus.waiter.Add(1)
+		go func(call kit.EnvelopeHandler) {
+			defer bus.waiter.Done()
+			//事件不重试，失败了只记录
+			if err := bus.call(channel, envelope, call); err != nil {
+				ark.Warning("bus.default.event", channel, err)
+			}
+		}(call)
+	}
+
 	return nil
 }
 
-//发起队列，限制线程
-func (bus *defaultBus) Enqueue(channel string, data []byte) error {
+//获取队列，不存在就创建，还没有消费者时消息先缓冲着
+func (bus *defaultBus) queue(channel string, buffer defaultBusBuffer) *defaultBusQueue {
 	bus.mutex.Lock()
 	defer bus.mutex.Unlock()
 
-	//这里不能阻塞线程
-	if cc, ok := bus.queues[channel]; ok {
-		go func() {
-			cc <- data
-		}()
+	if queue, ok := bus.queues[channel]; ok {
+		return queue
+	}
+
+	queue := &defaultBusQueue{
+		main: newDefaultBusLane(buffer.Depth), policy: buffer.Policy,
+	}
+	for i := 0; i < buffer.Partitions; i++ {
+		queue.shards = append(queue.shards, newDefaultBusLane(buffer.Depth))
+	}
+	bus.queues[channel] = queue
+	return queue
+}
+
+//发起队列，限制线程
+func (bus *defaultBus) Enqueue(channel string, envelope kit.Envelope, buffer defaultBusBuffer) error {
+	return bus.enqueue(channel, envelope, buffer)
+}
+
+//入队，队列满了按队列的策略处理
+func (bus *defaultBus) enqueue(channel string, value kit.Envelope, buffer defaultBusBuffer) error {
+	return bus.push(channel, value, buffer, "")
+}
+
+//转入死信，死信队列满了丢弃最早的，不能卡住处理线程
+func (bus *defaultBus) deadletter(channel string, value kit.Envelope, buffer defaultBusBuffer) error {
+	return bus.push(channel, value, buffer, defaultBusPolicyDrop)
+}
+
+//入队，policy为空时用队列的策略
+func (bus *defaultBus) push(channel string, value kit.Envelope, buffer defaultBusBuffer, policy string) error {
+	bus.mutex.Lock()
+	closed := bus.closed
+	bus.mutex.Unlock()
+	if closed {
+		return errDefaultBusClosed
+	}
+
+	queue := bus.queue(channel, buffer)
+	if policy == "" {
+		policy = queue.policy
+	}
+	//没有消费者的队列，满了再等就永远卡住了，改为丢弃最早的
+	if policy == defaultBusPolicyBlock && atomic.LoadInt64(&queue.workers) == 0 {
+		policy = defaultBusPolicyDrop
+	}
+
+	lane := queue.lane(value.Key)
+	lane.enqueued()
+
+	switch policy {
+	case defaultBusPolicyReject:
+		select {
+		case lane.values <- value:
+		default:
+			lane.unqueued()
+			return errDefaultBusFull
+		}
+	case defaultBusPolicyDrop:
+		for {
+			select {
+			case lane.values <- value:
+				return nil
+			default:
+			}
+			select {
+			case <-lane.values:
+				lane.dequeued()
+				ark.Warning("bus.default.dropped", channel, "full")
+			default:
+			}
+		}
+	default:
+		select {
+		case lane.values <- value:
+		case <-bus.stopper.ShouldStop():
+			lane.unqueued()
+			return errDefaultBusClosed
+		}
 	}
 
 	return nil
 }
 
+//全部的排队通道
+func (queue *defaultBusQueue) lanes() []*defaultBusLane {
+	return append([]*defaultBusLane{queue.main}, queue.shards...)
+}
+
+func newDefaultBusLane(depth int) *defaultBusLane {
+	return &defaultBusLane{values: make(chan kit.Envelope, depth)}
+}
+
+//记录入队时间
+func (lane *defaultBusLane) enqueued() {
+	lane.mutex.Lock()
+	defer lane.mutex.Unlock()
+	lane.times = append(lane.times, time.Now())
+}
+
+//入队失败，去掉刚记的时间
+func (lane *defaultBusLane) unqueued() {
+	lane.mutex.Lock()
+	defer lane.mutex.Unlock()
+	if len(lane.times) > 0 {
+		lane.times = lane.times[:len(lane.times)-1]
+	}
+}
+
+//出队，去掉最早的时间
+func (lane *defaultBusLane) dequeued() {
+	lane.mutex.Lock()
+	defer lane.mutex.Unlock()
+	if len(lane.times) > 0 {
+		lane.times = lane.times[1:]
+	}
+}
+
+//最早排队的消息等了多久
+func (lane *defaultBusLane) oldest() time.Duration {
+	lane.mutex.Lock()
+	defer lane.mutex.Unlock()
+	if len(lane.times) > 0 {
+		return time.Since(lane.times[0])
+	}
+	return 0
+}
+
+//队列的负载，排队中加处理中
+func (bus *defaultBus) Workload(channels ...string) int64 {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	workload := int64(0)
+	for _, channel := range channels {
+		if queue, ok := bus.queues[channel]; ok {
+			workload += atomic.LoadInt64(&queue.actives)
+			for _, lane := range queue.lanes() {
+				workload += int64(len(lane.values))
+			}
+		}
+	}
+	return workload
+}
+
+//处理队列消息，失败了按策略重试或转入死信
+func (bus *defaultBus) handle(channel string, value kit.Envelope, handler kit.EnvelopeHandler, retry kit.Retry, buffer defaultBusBuffer) {
+	if bus.duplicated(channel, value) {
+		ark.Warning("bus.default.duplicate", channel, value.Id)
+		return
+	}
+
+	err := bus.call(channel, value, handler)
+	if err == nil {
+		bus.dedupDone(channel, value)
+		return
+	}
+
+	//失败了取消占位，重试的消息还要能处理
+	bus.undedup(channel, value)
+
+	value.Attempt++
+	if value.Attempt <= retry.Retry {
+		time.AfterFunc(retry.Delay(value.Attempt), func() {
+			if err := bus.enqueue(channel, value, buffer); err != nil {
+				ark.Warning("bus.default.retry", channel, err)
+			}
+		})
+	} else {
+		bus.abandon(channel, value, retry, buffer, err)
+	}
+}
+
+//超过重试次数，转入死信或丢弃
+func (bus *defaultBus) abandon(channel string, value kit.Envelope, retry kit.Retry, buffer defaultBusBuffer, err error) {
+	if retry.Deadletter != "" {
+		if err := bus.deadletter(retry.Deadletter, value, buffer); err != nil {
+			ark.Warning("bus.default.deadletter", channel, err)
+		}
+	} else {
+		ark.Warning("bus.default.dropped", channel, value.Attempt, err)
+	}
+}
+
+//调用处理器，返回错误或panic视为失败
+func (bus *defaultBus) call(channel string, envelope kit.Envelope, handler kit.EnvelopeHandler) error {
+	return kit.Safe(func() error {
+		return handler(channel, envelope)
+	})
+}
+
 //------------------------- 默认队列驱动 end --------------------------
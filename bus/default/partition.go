@@ -0,0 +1,78 @@
+package bus
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/arkgo/driver/kit"
+)
+
+//------------------------- 分区队列 begin --------------------------
+//带分区键的消息按键哈希到固定的分区，每个分区只有一个线程按顺序处理
+//同一个键总在同一个分区里，入队的顺序就是处理的顺序
+
+//分区键对应的排队通道，没有键或不分区的走公共通道
+func (queue *defaultBusQueue) lane(key string) *defaultBusLane {
+	if key == "" || len(queue.shards) == 0 {
+		return queue.main
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return queue.shards[hash.Sum32()%uint32(len(queue.shards))]
+}
+
+//每个分区开一个线程
+func (bus *defaultBus) partitioning(channel string, queue *defaultBusQueue, handler kit.EnvelopeHandler, retry kit.Retry, buffer defaultBusBuffer) {
+	for _, shard := range queue.shards {
+		lane := shard
+		bus.stopper.RunWorker(func() {
+			for {
+				select {
+				case value := <-lane.values:
+					lane.dequeued()
+					atomic.AddInt64(&queue.actives, 1)
+					bus.sequenced(channel, value, handler, retry, buffer)
+					atomic.AddInt64(&queue.actives, -1)
+				case <-bus.stopper.ShouldStop():
+					return
+				}
+			}
+		})
+	}
+}
+
+//处理分区消息，失败了原地重试，保证同一个键的后续消息不会越过它
+func (bus *defaultBus) sequenced(channel string, value kit.Envelope, handler kit.EnvelopeHandler, retry kit.Retry, buffer defaultBusBuffer) {
+	if bus.duplicated(channel, value) {
+		ark.Warning("bus.default.duplicate", channel, value.Id)
+		return
+	}
+
+	for {
+		err := bus.call(channel, value, handler)
+		if err == nil {
+			bus.dedupDone(channel, value)
+			return
+		}
+
+		value.Attempt++
+		if value.Attempt > retry.Retry {
+			//彻底失败了取消占位，生产者重发的还要能处理
+			bus.undedup(channel, value)
+			bus.abandon(channel, value, retry, buffer, err)
+			return
+		}
+
+		select {
+		case <-time.After(retry.Delay(value.Attempt)):
+		case <-bus.stopper.ShouldStop():
+			bus.undedup(channel, value)
+			ark.Warning("bus.default.dropped", channel, value.Attempt, err)
+			return
+		}
+	}
+}
+
+//------------------------- 分区队列 end --------------------------
@@ -0,0 +1,107 @@
+package bus
+
+import (
+	"errors"
+	"time"
+
+	"github.com/arkgo/driver/kit"
+)
+
+//------------------------- 请求应答 begin --------------------------
+//每个请求自带一个应答通道，应答线程处理完写回，请求方超时即放弃
+
+var (
+	errDefaultBusTimeout   = errors.New("请求超时")
+	errDefaultBusResponder = errors.New("没有应答处理器")
+)
+
+type (
+	defaultBusRequest struct {
+		Data   []byte
+		Expiry time.Time
+		Reply  chan defaultBusReply
+	}
+	defaultBusReply struct {
+		Data  []byte
+		Error error
+	}
+)
+
+//注册应答，立即开始处理
+func (bus *defaultBus) Respond(name string, thread int, handler kit.RespondHandler) error {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	if _, ok := bus.requests[name]; ok == false {
+		bus.requests[name] = make(chan defaultBusRequest)
+	}
+
+	var requests = bus.requests[name]
+
+	for i := 0; i < thread; i++ {
+		bus.stopper.RunWorker(func() {
+			for {
+				select {
+				case req := <-requests:
+					//请求方已经放弃了
+					if time.Now().After(req.Expiry) {
+						continue
+					}
+					//panic视为失败
+					reply := defaultBusReply{}
+					reply.Error = kit.Safe(func() error {
+						data, err := handler(name, req.Data)
+						reply.Data = data
+						return err
+					})
+					req.Reply <- reply
+				case <-bus.stopper.ShouldStop():
+					return
+				}
+			}
+		})
+	}
+
+	return nil
+}
+
+//发起请求，等待应答
+func (bus *defaultBus) Request(name string, data []byte, timeout time.Duration) ([]byte, error) {
+	bus.mutex.Lock()
+	closed := bus.closed
+	requests, ok := bus.requests[name]
+	bus.mutex.Unlock()
+
+	if closed {
+		return nil, errDefaultBusClosed
+	}
+	if timeout <= 0 {
+		return nil, kit.ErrInvalidTimeout
+	}
+	if ok == false {
+		return nil, errDefaultBusResponder
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	//应答通道带缓冲，请求方超时走了，应答线程也不会卡住
+	req := defaultBusRequest{
+		Data: data, Expiry: time.Now().Add(timeout), Reply: make(chan defaultBusReply, 1),
+	}
+
+	select {
+	case requests <- req:
+	case <-timer.C:
+		return nil, errDefaultBusTimeout
+	}
+
+	select {
+	case reply := <-req.Reply:
+		return reply.Data, reply.Error
+	case <-timer.C:
+		return nil, errDefaultBusTimeout
+	}
+}
+
+//------------------------- 请求应答 end --------------------------
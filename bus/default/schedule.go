@@ -0,0 +1,63 @@
+package bus
+
+import (
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/arkgo/driver/kit"
+)
+
+//------------------------- 定时消息 begin --------------------------
+//进程内的定时任务，每个任务一个线程，到点发布或入队
+
+const (
+	defaultBusSchedulePublish = "publish"
+	defaultBusScheduleEnqueue = "enqueue"
+)
+
+//定时发布事件
+func (connect *defaultBusConnect) SchedulePublish(spec, name string, data []byte) error {
+	return connect.schedule(defaultBusSchedulePublish, spec, name, data)
+}
+
+//定时入队
+func (connect *defaultBusConnect) ScheduleEnqueue(spec, name string, data []byte) error {
+	return connect.schedule(defaultBusScheduleEnqueue, spec, name, data)
+}
+
+func (connect *defaultBusConnect) schedule(kind, spec, name string, data []byte) error {
+	cron, err := kit.ParseCron(spec)
+	if err != nil {
+		return err
+	}
+
+	connect.bus.stopper.RunWorker(func() {
+		next := cron.Next(time.Now())
+		for next.IsZero() == false {
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-timer.C:
+			case <-connect.bus.stopper.ShouldStop():
+				timer.Stop()
+				return
+			}
+
+			envelope := kit.Envelope{Headers: map[string]string{"schedule": spec}, Data: data}
+			var err error
+			if kind == defaultBusSchedulePublish {
+				err = connect.PublishEnvelope(name, envelope)
+			} else {
+				err = connect.EnqueueEnvelope(name, envelope)
+			}
+			if err != nil {
+				ark.Warning("bus.default.schedule", name, err)
+			}
+
+			next = cron.Next(time.Now())
+		}
+	})
+
+	return nil
+}
+
+//------------------------- 定时消息 end --------------------------
@@ -1,6 +1,8 @@
 package bus
 
 import (
+	_ "github.com/arkgo/driver/bus/buntdb"
 	_ "github.com/arkgo/driver/bus/default"
+	_ "github.com/arkgo/driver/bus/postgres"
 	_ "github.com/arkgo/driver/bus/redis"
 )
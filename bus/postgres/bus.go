@@ -0,0 +1,587 @@
+package bus_postgres
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/arkgo/asset/util"
+	"github.com/arkgo/driver/kit"
+	"github.com/lib/pq"
+)
+
+//------------------------- postgres队列驱动 begin --------------------------
+//事件走 LISTEN/NOTIFY，队列和延时消息存在表里，用 FOR UPDATE SKIP LOCKED 消费
+//NOTIFY 的内容上限8000字节，所以事件数据也写在表里，只通知编号，监听者再按编号读取
+//通知过的事件保留retention时长，给所有节点读取，之后清理掉
+//到期时间都用数据库的时间计算，各节点的时钟不一致也不影响
+
+const (
+	postgresBusKindEvent  = "event"
+	postgresBusKindNotify = "notify" //已经通知的事件，等待清理
+	postgresBusKindQueue  = "queue"
+
+	postgresBusWakeup = "_bus_queue" //入队后通知消费者的频道
+	postgresBusBatch  = 100
+)
+
+//支持的扩展
+var (
+	_ kit.EnvelopeBus = (*postgresBusConnect)(nil)
+	_ kit.ErrorBus    = (*postgresBusConnect)(nil)
+	_ kit.InspectBus  = (*postgresBusConnect)(nil)
+)
+
+type (
+	postgresBusDriver struct{}
+	postgresBusQueue  struct {
+		Thread  int
+		Handler kit.EnvelopeHandler
+		Actives *int64 //处理中的数量
+	}
+	postgresBusConnect struct {
+		mutex   sync.RWMutex
+		running bool
+		actives int64
+
+		name    string
+		config  ark.BusConfig
+		setting postgresBusSetting
+
+		eventHandler ark.EventHandler
+		queueHandler ark.QueueHandler
+
+		errorEventHandler kit.ErrorHandler
+		errorQueueHandler kit.ErrorHandler
+
+		envelopeEventHandler kit.EnvelopeHandler
+		envelopeQueueHandler kit.EnvelopeHandler
+
+		db       *sql.DB
+		listener *pq.Listener
+		stopper  *util.Stopper
+
+		events map[string]kit.EnvelopeHandler
+		queues map[string]postgresBusQueue
+		wakes  map[string]chan struct{}
+	}
+
+	postgresBusSetting struct {
+		Url       string
+		Schema    string
+		Table     string
+		Interval  time.Duration //空闲时轮询队列的间隔
+		Retention time.Duration //通知过的事件保留多久
+
+		Retries kit.Retries //重试策略，可以按队列单独配置
+	}
+)
+
+//连接
+func (driver *postgresBusDriver) Connect(name string, config ark.BusConfig) (ark.BusConnect, error) {
+
+	//获取配置信息
+	setting := postgresBusSetting{
+		Schema: "public", Table: "bus", Interval: time.Second, Retention: time.Minute,
+	}
+
+	if vv, ok := config.Setting["url"].(string); ok && vv != "" {
+		setting.Url = vv
+	}
+	//支持和数据驱动一样的schema
+	for _, s := range SCHEMAS {
+		if strings.HasPrefix(setting.Url, s) {
+			setting.Url = strings.Replace(setting.Url, s, "postgres://", 1)
+		}
+	}
+
+	if vv, ok := config.Setting["schema"].(string); ok && vv != "" {
+		setting.Schema = vv
+	}
+	if vv, ok := config.Setting["table"].(string); ok && vv != "" {
+		setting.Table = vv
+	}
+	if vv, ok := config.Setting["interval"].(int64); ok && vv > 0 {
+		setting.Interval = time.Second * time.Duration(vv)
+	}
+	if vv, ok := config.Setting["interval"].(string); ok && vv != "" {
+		td, err := util.ParseDuration(vv)
+		if err == nil {
+			setting.Interval = td
+		}
+	}
+
+	if vv, ok := config.Setting["retention"].(int64); ok && vv > 0 {
+		setting.Retention = time.Second * time.Duration(vv)
+	}
+	if vv, ok := config.Setting["retention"].(string); ok && vv != "" {
+		td, err := util.ParseDuration(vv)
+		if err == nil {
+			setting.Retention = td
+		}
+	}
+
+	//重试策略，可以按队列单独配置
+	setting.Retries = kit.RetriesSetting(config.Setting, kit.Retry{Backoff: time.Second})
+
+	return &postgresBusConnect{
+		name: name, config: config, setting: setting, stopper: util.NewStopper(),
+		events: make(map[string]kit.EnvelopeHandler, 0),
+		queues: make(map[string]postgresBusQueue, 0),
+		wakes:  make(map[string]chan struct{}, 0),
+	}, nil
+}
+
+//打开连接
+func (connect *postgresBusConnect) Open() error {
+	if connect.setting.Url == "" {
+		return errors.New("[队列]无效连接")
+	}
+
+	db, err := sql.Open("postgres", connect.setting.Url)
+	if err != nil {
+		return err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return err
+	}
+
+	//建表
+	_, err = db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			"id" BIGSERIAL PRIMARY KEY,
+			"kind" VARCHAR(10) NOT NULL,
+			"name" VARCHAR(255) NOT NULL,
+			"data" BYTEA NOT NULL,
+			"attempt" INTEGER NOT NULL DEFAULT 0,
+			"due" TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS "%s_due" ON %s ("kind", "name", "due", "id");
+	`, connect.table(), connect.setting.Table, connect.table()))
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	connect.db = db
+	return nil
+}
+func (connect *postgresBusConnect) Health() (ark.BusHealth, error) {
+	return ark.BusHealth{Workload: atomic.LoadInt64(&connect.actives)}, nil
+}
+
+//关闭连接
+func (connect *postgresBusConnect) Close() error {
+	connect.stopper.Stop()
+
+	if connect.listener != nil {
+		connect.listener.Close()
+	}
+	if connect.db != nil {
+		if err := connect.db.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//注册回调
+func (connect *postgresBusConnect) Accept(eventHandler ark.EventHandler, queueHandler ark.QueueHandler) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	connect.eventHandler = eventHandler
+	connect.queueHandler = queueHandler
+
+	return nil
+}
+
+//注册返回错误的回调，返回错误视为处理失败
+func (connect *postgresBusConnect) AcceptError(eventHandler, queueHandler kit.ErrorHandler) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	connect.errorEventHandler = eventHandler
+	connect.errorQueueHandler = queueHandler
+
+	return nil
+}
+
+//注册事件
+func (connect *postgresBusConnect) Event(channel string) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+	connect.events[channel] = kit.Handler(connect.envelopeEventHandler, connect.errorEventHandler, connect.eventHandler)
+	return nil
+}
+
+//注册队列
+func (connect *postgresBusConnect) Queue(channel string, thread int) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	if thread <= 0 {
+		thread = 1
+	}
+	handler := kit.Handler(connect.envelopeQueueHandler, connect.errorQueueHandler, connect.queueHandler)
+	connect.queues[channel] = postgresBusQueue{thread, handler, new(int64)}
+	connect.wakes[channel] = make(chan struct{}, 1)
+
+	return nil
+}
+
+//开始订阅者
+func (connect *postgresBusConnect) Start() error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	connect.listener = pq.NewListener(connect.setting.Url, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			ark.Warning("bus.postgres.listener", err)
+		}
+	})
+
+	names := []string{connect.config.Prefix + postgresBusWakeup}
+	for name, _ := range connect.events {
+		names = append(names, connect.config.Prefix+name)
+	}
+	for _, name := range names {
+		if err := connect.listener.Listen(name); err != nil {
+			return err
+		}
+	}
+
+	//监听事件
+	connect.stopper.RunWorker(connect.eventing)
+	//搬运到期的延时事件
+	connect.stopper.RunWorker(connect.delaying)
+	//监听队列
+	for k, v := range connect.queues {
+		name := k
+		for i := 0; i < v.Thread; i++ {
+			connect.stopper.RunWorker(func() {
+				connect.queueing(name)
+			})
+		}
+	}
+
+	connect.running = true
+	return nil
+}
+
+func (connect *postgresBusConnect) Publish(name string, data []byte, delays ...time.Duration) error {
+	return connect.publish(name, data, delays...)
+}
+func (connect *postgresBusConnect) Enqueue(name string, data []byte, delays ...time.Duration) error {
+	return connect.enqueue(name, data, delays...)
+}
+
+//发布，数据已经是最终写入的格式
+func (connect *postgresBusConnect) publish(name string, data []byte, delays ...time.Duration) error {
+	if connect.db == nil {
+		return ark.Fail
+	}
+
+	//延时事件先入表，到期再通知
+	if len(delays) > 0 && delays[0] > 0 {
+		return connect.insert(postgresBusKindEvent, name, data, delays[0])
+	}
+
+	//写入表再通知编号，数据大小不受NOTIFY限制
+	realName := connect.config.Prefix + name
+	_, err := connect.db.Exec(fmt.Sprintf(`
+		WITH "ins" AS (
+			INSERT INTO %s ("kind","name","data") VALUES ($1,$2,$3) RETURNING "id"
+		) SELECT pg_notify($2, "id"::text) FROM "ins"
+	`, connect.table()), postgresBusKindNotify, realName, data)
+	if err != nil {
+		ark.Warning("bus.postgres.publish", err)
+		return err
+	}
+
+	return nil
+}
+
+//入队，数据已经是最终写入的格式
+func (connect *postgresBusConnect) enqueue(name string, data []byte, delays ...time.Duration) error {
+	if connect.db == nil {
+		return ark.Fail
+	}
+
+	delay := time.Duration(0)
+	if len(delays) > 0 && delays[0] > 0 {
+		delay = delays[0]
+	}
+
+	return connect.insert(postgresBusKindQueue, name, data, delay)
+}
+
+//表名
+func (connect *postgresBusConnect) table() string {
+	return fmt.Sprintf(`"%s"."%s"`, connect.setting.Schema, connect.setting.Table)
+}
+
+//写入表，没有延时的队列消息，通知消费者马上处理
+func (connect *postgresBusConnect) insert(kind, name string, data []byte, delay time.Duration) error {
+	realName := connect.config.Prefix + name
+
+	_, err := connect.db.Exec(
+		fmt.Sprintf(`INSERT INTO %s ("kind","name","data","due") VALUES ($1,$2,$3,now()+$4*interval '1 millisecond')`, connect.table()),
+		kind, realName, data, delay.Milliseconds(),
+	)
+	if err != nil {
+		ark.Warning("bus.postgres."+kind, err)
+		return err
+	}
+
+	if kind == postgresBusKindQueue && delay <= 0 {
+		connect.db.Exec(`SELECT pg_notify($1, $2)`, connect.config.Prefix+postgresBusWakeup, name)
+	}
+
+	return nil
+}
+
+//唤醒队列消费者
+func (connect *postgresBusConnect) wakeup(name string) {
+	if wake, ok := connect.wakes[name]; ok {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//事件监听
+func (connect *postgresBusConnect) eventing() {
+	wakeup := connect.config.Prefix + postgresBusWakeup
+
+	for {
+		select {
+		case n := <-connect.listener.Notify:
+			if n == nil {
+				//重连过，期间的入队通知可能丢了，全部唤醒一次
+				for name, _ := range connect.wakes {
+					connect.wakeup(name)
+				}
+				continue
+			}
+			if n.Channel == wakeup {
+				connect.wakeup(n.Extra)
+				continue
+			}
+
+			channel := strings.Replace(n.Channel, connect.config.Prefix, "", 1)
+			if call, ok := connect.events[channel]; ok {
+				data, err := connect.notified(n.Extra)
+				if err != nil {
+					ark.Warning("bus.postgres.event", channel, err)
+					continue
+				}
+				go func() {
+					//事件不重试，失败了只记录
+					envelope := kit.DecodeEnvelope(data)
+					if err := kit.Safe(func() error { return call(channel, envelope) }); err != nil {
+						ark.Warning("bus.postgres.event", channel, err)
+					}
+				}()
+			}
+		case <-time.After(time.Minute):
+			//检查连接，断线会自动重连
+			go connect.listener.Ping()
+		case <-connect.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+//按通知的编号读取事件数据
+func (connect *postgresBusConnect) notified(extra string) ([]byte, error) {
+	id, err := strconv.ParseInt(extra, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	data := []byte{}
+	row := connect.db.QueryRow(fmt.Sprintf(`SELECT "data" FROM %s WHERE "id"=$1`, connect.table()), id)
+	if err := row.Scan(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+//定时把到期的延时事件发出去，顺便清理保留期已过的事件
+//更新和通知在同一事务内，提交后才会真正发出，多节点也只会发一次
+func (connect *postgresBusConnect) delaying() {
+	ticker := time.NewTicker(connect.setting.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			//满一批说明可能还有，接着搬
+			for {
+				if connect.delayed() < postgresBusBatch {
+					break
+				}
+			}
+			connect.expired()
+		case <-connect.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+func (connect *postgresBusConnect) delayed() int {
+	tx, err := connect.db.Begin()
+	if err != nil {
+		ark.Warning("bus.postgres.delayed", err)
+		return 0
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(fmt.Sprintf(`
+		UPDATE %s SET "kind"=$2, "due"=now() WHERE "id" IN (
+			SELECT "id" FROM %s WHERE "kind"=$1 AND "due"<=now()
+			ORDER BY "id" LIMIT %d FOR UPDATE SKIP LOCKED
+		) RETURNING "id", "name"
+	`, connect.table(), connect.table(), postgresBusBatch), postgresBusKindEvent, postgresBusKindNotify)
+	if err != nil {
+		ark.Warning("bus.postgres.delayed", err)
+		return 0
+	}
+
+	ids, names := []int64{}, []string{}
+	for rows.Next() {
+		id, name := int64(0), ""
+		if err := rows.Scan(&id, &name); err == nil {
+			ids = append(ids, id)
+			names = append(names, name)
+		}
+	}
+	rows.Close()
+
+	for i, name := range names {
+		if _, err := tx.Exec(`SELECT pg_notify($1, $2)`, name, strconv.FormatInt(ids[i], 10)); err != nil {
+			ark.Warning("bus.postgres.delayed", err)
+			return 0
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		ark.Warning("bus.postgres.delayed", err)
+		return 0
+	}
+
+	return len(names)
+}
+
+//清理保留期已过的事件
+func (connect *postgresBusConnect) expired() {
+	_, err := connect.db.Exec(
+		fmt.Sprintf(`DELETE FROM %s WHERE "kind"=$1 AND "due"<now()-$2*interval '1 millisecond'`, connect.table()),
+		postgresBusKindNotify, connect.setting.Retention.Milliseconds(),
+	)
+	if err != nil {
+		ark.Warning("bus.postgres.expired", err)
+	}
+}
+
+//队列监听
+func (connect *postgresBusConnect) queueing(name string) {
+	wake := connect.wakes[name]
+
+	for {
+		select {
+		case <-connect.stopper.ShouldStop():
+			return
+		default:
+		}
+
+		//有消息就接着处理，没有就等通知或是轮询
+		if connect.dequeue(name) {
+			continue
+		}
+
+		select {
+		case <-wake:
+		case <-time.After(connect.setting.Interval):
+		case <-connect.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+//取一条消息处理，处理期间一直持有行锁
+//进程崩溃时事务回滚，消息会被其它消费者重新取到
+func (connect *postgresBusConnect) dequeue(name string) bool {
+	call, ok := connect.queues[name]
+	if ok == false {
+		return false
+	}
+
+	tx, err := connect.db.Begin()
+	if err != nil {
+		ark.Warning("bus.postgres.dequeue", err)
+		return false
+	}
+	defer tx.Rollback()
+
+	id, data, attempt := int64(0), []byte{}, 0
+	row := tx.QueryRow(fmt.Sprintf(`
+		SELECT "id", "data", "attempt" FROM %s
+		WHERE "kind"=$1 AND "name"=$2 AND "due"<=now()
+		ORDER BY "id" LIMIT 1 FOR UPDATE SKIP LOCKED
+	`, connect.table()), postgresBusKindQueue, connect.config.Prefix+name)
+	if err := row.Scan(&id, &data, &attempt); err != nil {
+		if err != sql.ErrNoRows {
+			ark.Warning("bus.postgres.dequeue", err)
+		}
+		return false
+	}
+
+	envelope := kit.DecodeEnvelope(data)
+	envelope.Attempt = attempt
+	err = kit.Handle(func() error {
+		return call.Handler(name, envelope)
+	}, &connect.actives, call.Actives)
+	if err == nil {
+		_, err = tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE "id"=$1`, connect.table()), id)
+	} else {
+		retry := connect.setting.Retries.Queue(name)
+		attempt++
+
+		if attempt <= retry.Retry {
+			_, err = tx.Exec(
+				fmt.Sprintf(`UPDATE %s SET "attempt"=$1, "due"=now()+$2*interval '1 millisecond' WHERE "id"=$3`, connect.table()),
+				attempt, retry.Delay(attempt).Milliseconds(), id,
+			)
+		} else if retry.Deadletter != "" {
+			_, err = tx.Exec(
+				fmt.Sprintf(`UPDATE %s SET "name"=$1, "attempt"=$2, "due"=now() WHERE "id"=$3`, connect.table()),
+				connect.config.Prefix+retry.Deadletter, attempt, id,
+			)
+		} else {
+			ark.Warning("bus.postgres.dropped", name, attempt, err)
+			_, err = tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE "id"=$1`, connect.table()), id)
+		}
+	}
+	if err != nil {
+		ark.Warning("bus.postgres.dequeue", err)
+		return true
+	}
+
+	if err := tx.Commit(); err != nil {
+		ark.Warning("bus.postgres.dequeue", err)
+	}
+
+	return true
+}
+
+//------------------------- postgres队列驱动 end --------------------------
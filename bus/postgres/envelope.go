@@ -0,0 +1,42 @@
+package bus_postgres
+
+import (
+	"time"
+
+	"github.com/arkgo/driver/kit"
+)
+
+//------------------------- 消息信封 begin --------------------------
+//带信封的消息序列化后写入data，读取时裸消息和信封都能解析
+//重试次数以表里的attempt为准；分区键原样带给处理器，但不保证顺序，也不去重
+
+//注册带信封的回调，注册后处理器拿到完整信封，返回错误视为处理失败
+func (connect *postgresBusConnect) AcceptEnvelope(eventHandler, queueHandler kit.EnvelopeHandler) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	connect.envelopeEventHandler = eventHandler
+	connect.envelopeQueueHandler = queueHandler
+
+	return nil
+}
+
+//发布带信封的消息，编号和时间为空时自动生成
+func (connect *postgresBusConnect) PublishEnvelope(name string, envelope kit.Envelope, delays ...time.Duration) error {
+	data, err := kit.EncodeEnvelope(kit.SealEnvelope(envelope))
+	if err != nil {
+		return err
+	}
+	return connect.publish(name, data, delays...)
+}
+
+//入队带信封的消息，编号和时间为空时自动生成
+func (connect *postgresBusConnect) EnqueueEnvelope(name string, envelope kit.Envelope, delays ...time.Duration) error {
+	data, err := kit.EncodeEnvelope(kit.SealEnvelope(envelope))
+	if err != nil {
+		return err
+	}
+	return connect.enqueue(name, data, delays...)
+}
+
+//------------------------- 消息信封 end --------------------------
@@ -0,0 +1,78 @@
+package bus_postgres
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/arkgo/driver/kit"
+)
+
+//------------------------- 队列查看 begin --------------------------
+//排队数和最早消息从表里查，整个集群共用；处理中的数量是本节点的
+
+//查看队列，不指定就是本连接注册的全部队列
+func (connect *postgresBusConnect) Inspect(names ...string) ([]kit.QueueStats, error) {
+	if connect.db == nil {
+		return nil, ark.Fail
+	}
+
+	connect.mutex.RLock()
+	if len(names) == 0 {
+		for name, _ := range connect.queues {
+			names = append(names, name)
+		}
+	}
+	queues := make(map[string]postgresBusQueue, len(names))
+	for _, name := range names {
+		if queue, ok := connect.queues[name]; ok {
+			queues[name] = queue
+		}
+	}
+	connect.mutex.RUnlock()
+	sort.Strings(names)
+
+	stats := make([]kit.QueueStats, 0, len(names))
+	for _, name := range names {
+		stat := kit.QueueStats{Name: name}
+		if queue, ok := queues[name]; ok {
+			stat.Workers = queue.Thread
+			stat.Actives = atomic.LoadInt64(queue.Actives)
+		}
+
+		length, oldest, err := connect.inspect(name)
+		if err != nil {
+			return nil, err
+		}
+		stat.Length, stat.Oldest = length, oldest
+
+		if retry := connect.setting.Retries.Queue(name); retry.Deadletter != "" {
+			length, _, err := connect.inspect(retry.Deadletter)
+			if err != nil {
+				return nil, err
+			}
+			stat.Deadletter = length
+		}
+
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+//排队数，和已到期的最早消息等了多久
+func (connect *postgresBusConnect) inspect(name string) (int64, time.Duration, error) {
+	length, oldest := int64(0), int64(0)
+	row := connect.db.QueryRow(fmt.Sprintf(`
+		SELECT count(*), COALESCE(floor(EXTRACT(EPOCH FROM now()-min("due") FILTER (WHERE "due"<=now()))*1000), 0)::bigint
+		FROM %s WHERE "kind"=$1 AND "name"=$2
+	`, connect.table()), postgresBusKindQueue, connect.config.Prefix+name)
+	if err := row.Scan(&length, &oldest); err != nil {
+		return 0, 0, err
+	}
+	return length, time.Duration(oldest) * time.Millisecond, nil
+}
+
+//------------------------- 队列查看 end --------------------------
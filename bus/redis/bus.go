@@ -1,27 +1,50 @@
 package bus_redis
 
 import (
+	"errors"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/arkgo/ark"
 	. "github.com/arkgo/asset"
 	"github.com/arkgo/asset/util"
+	"github.com/arkgo/driver/kit"
 	"github.com/gomodule/redigo/redis"
 )
 
 //------------------------- 默认队列驱动 begin --------------------------
 
+const (
+	redisBusPingInterval = time.Second * 30
+	redisBusMaxBackoff   = time.Second * 30
+)
+
+var (
+	errRedisBusClosed = errors.New("队列已关闭")
+)
+
+//支持的扩展
+var (
+	_ kit.EnvelopeBus = (*redisBusConnect)(nil)
+	_ kit.ErrorBus    = (*redisBusConnect)(nil)
+	_ kit.RequestBus  = (*redisBusConnect)(nil)
+	_ kit.ScheduleBus = (*redisBusConnect)(nil)
+	_ kit.InspectBus  = (*redisBusConnect)(nil)
+)
+
 type (
 	redisBusDriver struct{}
 	redisBusQueue  struct {
 		Thread  int
-		Handler ark.QueueHandler
+		Handler kit.EnvelopeHandler
+		Actives *int64 //处理中的数量
 	}
 	redisBusConnect struct {
 		mutex   sync.RWMutex
 		running bool
+		closed  bool
 		actives int64
 
 		name    string
@@ -31,15 +54,30 @@ type (
 		eventHandler ark.EventHandler
 		queueHandler ark.QueueHandler
 
+		errorEventHandler kit.ErrorHandler
+		errorQueueHandler kit.ErrorHandler
+
+		envelopeEventHandler kit.EnvelopeHandler
+		envelopeQueueHandler kit.EnvelopeHandler
+
 		client *redis.Pool
 
-		events       map[string]ark.EventHandler
+		events       map[string]kit.EnvelopeHandler
 		eventStopper *util.Stopper
 		eventCloser  string
 
 		queues       map[string]redisBusQueue
 		queueStopper *util.Stopper
 		queueCloser  string
+
+		consumer string //stream模式的消费者名
+
+		responders map[string]redisBusResponder
+
+		delayStopper *util.Stopper
+		schedules    []*redisBusSchedule
+
+		waiter sync.WaitGroup //处理中的事件
 	}
 
 	redisBusSetting struct {
@@ -50,6 +88,17 @@ type (
 		Idle    int //最大空闲连接
 		Active  int //最大激活连接，同时最大并发
 		Timeout time.Duration
+		Drain   time.Duration //关闭时等待处理中消息的最长时间
+
+		Mode        string         //队列模式，list 或 stream
+		Group       string         //stream模式的消费组
+		Visibility  time.Duration  //stream模式下，未确认的消息超过此时间重新投递，也是分区租约的时长，去重占位取一半
+		Partitions  int            //带分区键的消息分到多少个分区，0为不分区
+		Partitioned map[string]int //按队列的分区数
+		Envelope    bool           //Publish和Enqueue是否包上信封，滚动升级时先关闭
+
+		Retries kit.Retries   //重试策略，可以按队列单独配置
+		Dedup   time.Duration //去重窗口，窗口内相同编号的队列消息只处理一次，0为不去重
 	}
 )
 
@@ -59,7 +108,8 @@ func (driver *redisBusDriver) Connect(name string, config ark.BusConfig) (ark.Bu
 	//获取配置信息
 	setting := redisBusSetting{
 		Server: "127.0.0.1:6379", Password: "", Database: "",
-		Idle: 30, Active: 100, Timeout: 240,
+		Idle: 30, Active: 100, Timeout: time.Second * 240, Drain: time.Second * 10,
+		Mode: redisBusModeList, Group: "ark", Visibility: time.Second * 30, Partitions: 0, Envelope: true,
 	}
 	if vv, ok := config.Setting["server"].(string); ok && vv != "" {
 		setting.Server = vv
@@ -89,14 +139,63 @@ func (driver *redisBusDriver) Connect(name string, config ark.BusConfig) (ark.Bu
 		}
 	}
 
+	if vv, ok := config.Setting["drain"].(int64); ok && vv > 0 {
+		setting.Drain = time.Second * time.Duration(vv)
+	}
+	if vv, ok := config.Setting["drain"].(string); ok && vv != "" {
+		td, err := util.ParseDuration(vv)
+		if err == nil {
+			setting.Drain = td
+		}
+	}
+
+	//队列模式，stream模式基于消费组，处理中崩溃的消息会重新投递
+	if vv, ok := config.Setting["mode"].(string); ok && vv != "" {
+		setting.Mode = strings.ToLower(vv)
+	}
+	if vv, ok := config.Setting["group"].(string); ok && vv != "" {
+		setting.Group = vv
+	}
+	if vv, ok := config.Setting["visibility"].(int64); ok && vv > 0 {
+		setting.Visibility = time.Second * time.Duration(vv)
+	}
+	if vv, ok := config.Setting["visibility"].(string); ok && vv != "" {
+		td, err := util.ParseDuration(vv)
+		if err == nil {
+			setting.Visibility = td
+		}
+	}
+
+	//分区数，可以按队列单独配置，只有分了区的队列才会启动分区线程
+	setting.Partitions, setting.Partitioned = redisBusPartitionSetting(config.Setting)
+
+	if vv, ok := config.Setting["envelope"].(bool); ok {
+		setting.Envelope = vv
+	}
+
+	//重试策略，可以按队列单独配置
+	setting.Retries = kit.RetriesSetting(config.Setting, kit.Retry{Backoff: time.Second})
+
+	if vv, ok := config.Setting["dedup"].(int64); ok && vv > 0 {
+		setting.Dedup = time.Second * time.Duration(vv)
+	}
+	if vv, ok := config.Setting["dedup"].(string); ok && vv != "" {
+		td, err := util.ParseDuration(vv)
+		if err == nil {
+			setting.Dedup = td
+		}
+	}
+
 	// if config.Thread <= 0 {
 	// 	config.Thread = 20 //默认100个线程执行队列
-	// }
+	//}
 
 	return &redisBusConnect{
 		name: name, config: config, setting: setting,
-		events: make(map[string]ark.EventHandler, 0), eventStopper: util.NewStopper(), eventCloser: ark.Unique(config.Prefix),
+		events: make(map[string]kit.EnvelopeHandler, 0), eventStopper: util.NewStopper(), eventCloser: ark.Unique(config.Prefix),
 		queues: make(map[string]redisBusQueue, 0), queueStopper: util.NewStopper(), queueCloser: ark.Unique(config.Prefix),
+		consumer: ark.Unique(config.Prefix), delayStopper: util.NewStopper(),
+		responders: make(map[string]redisBusResponder, 0),
 	}, nil
 }
 
@@ -145,25 +244,70 @@ func (connect *redisBusConnect) Open() error {
 	return conn.Err()
 }
 func (connect *redisBusConnect) Health() (ark.BusHealth, error) {
-	connect.mutex.RLock()
-	defer connect.mutex.RUnlock()
-	return ark.BusHealth{Workload: connect.actives}, nil
+	return ark.BusHealth{Workload: atomic.LoadInt64(&connect.actives)}, nil
 }
 
 //关闭连接
+//不再接收新消息，等处理中的消息完成，最多等待drain，然后才关闭连接池
 func (connect *redisBusConnect) Close() error {
-	if connect.client != nil {
+	if connect.client == nil {
+		return nil
+	}
+
+	connect.mutex.Lock()
+	connect.closed = true
+	connect.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		//结束延时搬运和定时任务
+		connect.delayStopper.Stop()
 
 		//结束事件
-		connect.Publish(connect.eventCloser, []byte{})
-		//结束队列，待优化
-		for k, _ := range connect.queues {
-			connect.Enqueue(k+connect.queueCloser, []byte{})
-		}
+		connect.publish(connect.eventCloser, []byte{})
+		connect.eventStopper.Stop()
+
+		//结束队列，list模式和分区线程每个线程发一个结束消息，stream模式会自己检查
+		connect.closeQueues()
+		connect.queueStopper.Stop()
 
-		connect.client.Close()
+		connect.waiter.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(connect.setting.Drain):
+		ark.Warning("bus.redis.drain", connect.name, "timeout")
+	}
+
+	return connect.client.Close()
+}
+
+//给每个队列线程发结束消息
+func (connect *redisBusConnect) closeQueues() {
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	for name, queue := range connect.queues {
+		keys := []string{}
+		if connect.setting.Mode != redisBusModeStream {
+			keys = append(keys, connect.config.Prefix+name+connect.queueCloser)
+		}
+		if connect.partitions(name) > 0 {
+			keys = append(keys, connect.config.Prefix+name+redisBusPartitionKey+connect.queueCloser)
+		}
+		for _, key := range keys {
+			for i := 0; i < queue.Thread; i++ {
+				conn.Send("LPUSH", key, "")
+			}
+			//线程已经退出的话，结束消息不要一直留着
+			conn.Send("EXPIRE", key, 60)
+		}
+	}
+	if _, err := conn.Do(""); err != nil {
+		ark.Warning("bus.redis.close", err)
 	}
-	return nil
 }
 
 //注册回调
@@ -177,11 +321,28 @@ func (connect *redisBusConnect) Accept(eventHandler ark.EventHandler, queueHandl
 	return nil
 }
 
+//注册返回错误的回调，返回错误视为处理失败
+func (connect *redisBusConnect) AcceptError(eventHandler, queueHandler kit.ErrorHandler) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	connect.errorEventHandler = eventHandler
+	connect.errorQueueHandler = queueHandler
+
+	return nil
+}
+
 //注册事件
 func (connect *redisBusConnect) Event(channel string) error {
+	if kit.Pattern(channel) {
+		if err := kit.ValidPattern(channel); err != nil {
+			return err
+		}
+	}
+
 	connect.mutex.Lock()
 	defer connect.mutex.Unlock()
-	connect.events[channel] = connect.eventHandler
+	connect.events[channel] = kit.Handler(connect.envelopeEventHandler, connect.errorEventHandler, connect.eventHandler)
 	return nil
 }
 
@@ -194,7 +355,8 @@ func (connect *redisBusConnect) Queue(channel string, thread int) error {
 	if thread <= 0 {
 		thread = 1
 	}
-	connect.queues[channel] = redisBusQueue{thread, connect.queueHandler}
+	handler := kit.Handler(connect.envelopeQueueHandler, connect.errorQueueHandler, connect.queueHandler)
+	connect.queues[channel] = redisBusQueue{thread, handler, new(int64)}
 
 	return nil
 
@@ -217,9 +379,42 @@ func (connect *redisBusConnect) Queue(channel string, thread int) error {
 }
 
 func (connect *redisBusConnect) Publish(name string, data []byte, delays ...time.Duration) error {
+	if connect.setting.Envelope {
+		return connect.PublishEnvelope(name, kit.Envelope{Data: data}, delays...)
+	}
+	if connect.client == nil {
+		return ark.Fail
+	}
+	if connect.isClosed() {
+		return errRedisBusClosed
+	}
+	return connect.publish(name, data, delays...)
+}
+func (connect *redisBusConnect) Enqueue(name string, data []byte, delays ...time.Duration) error {
+	if connect.setting.Envelope {
+		return connect.EnqueueEnvelope(name, kit.Envelope{Data: data}, delays...)
+	}
 	if connect.client == nil {
 		return ark.Fail
 	}
+	if connect.isClosed() {
+		return errRedisBusClosed
+	}
+	return connect.route(name, kit.Envelope{Data: data}, data, delays...)
+}
+
+func (connect *redisBusConnect) isClosed() bool {
+	connect.mutex.RLock()
+	defer connect.mutex.RUnlock()
+	return connect.closed
+}
+
+//发布，关闭过程中内部还需要用到
+func (connect *redisBusConnect) publish(name string, data []byte, delays ...time.Duration) error {
+	//延时消息，持久化到redis，到期再发布
+	if len(delays) > 0 && delays[0] > 0 {
+		return connect.delay(redisBusDelayPublish, name, data, delays[0])
+	}
 
 	conn := connect.client.Get()
 	defer conn.Close()
@@ -235,9 +430,16 @@ func (connect *redisBusConnect) Publish(name string, data []byte, delays ...time
 
 	return nil
 }
-func (connect *redisBusConnect) Enqueue(name string, data []byte, delays ...time.Duration) error {
-	if connect.client == nil {
-		return ark.Fail
+
+//入队，关闭过程中重试和死信还需要用到
+func (connect *redisBusConnect) enqueue(name string, data []byte, delays ...time.Duration) error {
+	//延时消息，持久化到redis，到期再入队
+	if len(delays) > 0 && delays[0] > 0 {
+		kind := redisBusDelayList
+		if connect.setting.Mode == redisBusModeStream {
+			kind = redisBusDelayStream
+		}
+		return connect.delay(kind, name, data, delays[0])
 	}
 
 	conn := connect.client.Get()
@@ -245,7 +447,12 @@ func (connect *redisBusConnect) Enqueue(name string, data []byte, delays ...time
 
 	//写入
 	realName := connect.config.Prefix + name
-	_, err := conn.Do("LPUSH", realName, string(data))
+	var err error
+	if connect.setting.Mode == redisBusModeStream {
+		_, err = conn.Do("XADD", realName, "*", redisBusStreamField, data)
+	} else {
+		_, err = conn.Do("LPUSH", realName, string(data))
+	}
 	if err != nil {
 		ark.Warning("bus.redis.enqueue", err)
 		return err
@@ -259,14 +466,39 @@ func (connect *redisBusConnect) Start() error {
 	connect.mutex.Lock()
 	defer connect.mutex.Unlock()
 
+	//搬运到期的延时消息
+	connect.delayStopper.RunWorker(connect.delaying)
+	//触发定时任务
+	connect.delayStopper.RunWorker(connect.scheduling)
 	//监听事件
 	connect.eventStopper.RunWorker(connect.eventing)
 	//监听队列
 	for k, v := range connect.queues {
+		name := k
+		for i := 0; i < v.Thread; i++ {
+			if connect.setting.Mode == redisBusModeStream {
+				connect.queueStopper.RunWorker(func() {
+					connect.streaming(name)
+				})
+			} else {
+				connect.queueStopper.RunWorker(func() {
+					connect.queueing(name)
+				})
+			}
+			//分区消息
+			if connect.partitions(name) > 0 {
+				connect.queueStopper.RunWorker(func() {
+					connect.partitioning(name)
+				})
+			}
+		}
+	}
+	//应答请求
+	for k, v := range connect.responders {
 		name := k
 		for i := 0; i < v.Thread; i++ {
 			connect.queueStopper.RunWorker(func() {
-				connect.queueing(name)
+				connect.responding(name)
 			})
 		}
 	}
@@ -275,43 +507,115 @@ func (connect *redisBusConnect) Start() error {
 }
 
 //事件监听
+//连接断开后按退避时间重连，并重新订阅全部频道
 func (connect *redisBusConnect) eventing() {
+	failures := 0
+	for {
+		closed, subscribed, err := connect.subscribe(failures > 0)
+		if closed {
+			return
+		}
+		if subscribed {
+			failures = 0
+		}
 
-	names := []Any{
-		connect.config.Prefix + connect.eventCloser,
+		failures++
+		delay := redisBusBackoff(failures)
+		ark.Warning("bus.redis.eventing", "disconnected", delay, err)
+		if connect.sleep(connect.eventStopper, delay) == false {
+			return
+		}
 	}
+}
+
+//订阅并接收事件，直到连接出错，收到结束消息时closed为true
+func (connect *redisBusConnect) subscribe(reconnect bool) (closed bool, subscribed bool, err error) {
+	//通配的频道，如 order.*，走PSUBSCRIBE
+	names, patterns := []Any{
+		connect.config.Prefix + connect.eventCloser,
+	}, []Any{}
 	for name, _ := range connect.events {
-		names = append(names, connect.config.Prefix+name)
+		if kit.Pattern(name) {
+			patterns = append(patterns, connect.config.Prefix+name)
+		} else {
+			names = append(names, connect.config.Prefix+name)
+		}
 	}
 
 	conn := connect.client.Get()
 	defer conn.Close()
 
 	psc := redis.PubSubConn{Conn: conn}
-	psc.Subscribe(names...) //一次订阅多个
+	if err := psc.Subscribe(names...); err != nil { //一次订阅多个
+		return false, false, err
+	}
+	if len(patterns) > 0 {
+		if err := psc.PSubscribe(patterns...); err != nil {
+			return false, false, err
+		}
+	}
+
+	//定时ping，超时没有任何回复就当连接断了
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(redisBusPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
 
 	for {
-		switch rec := psc.Receive().(type) {
+		switch rec := psc.ReceiveWithTimeout(redisBusPingInterval * 3).(type) {
 		case redis.Message:
 			channel := strings.Replace(rec.Channel, connect.config.Prefix, "", 1)
 			if channel == connect.eventCloser {
-				break //这里退出
-			} else {
-				if call, ok := connect.events[channel]; ok {
-					go call(channel, rec.Data)
+				//取消订阅，退出
+				psc.Unsubscribe(names...)
+				if len(patterns) > 0 {
+					psc.PUnsubscribe(patterns...)
 				}
+				return true, subscribed, nil
+			}
+			//通配订阅按模式找处理器，处理器拿到的是实际频道
+			name := channel
+			if rec.Pattern != "" {
+				name = strings.Replace(rec.Pattern, connect.config.Prefix, "", 1)
+			}
+			if call, ok := connect.events[name]; ok {
+				connect.waiter.Add(1)
+				go func(data []byte) {
+					defer connect.waiter.Done()
+					//事件不重试，失败了只记录
+					envelope := kit.DecodeEnvelope(data)
+					err := kit.Safe(func() error {
+						return call(channel, envelope)
+					})
+					if err != nil {
+						ark.Warning("bus.redis.event", channel, err)
+					}
+				}(rec.Data)
 			}
 		case redis.Subscription:
+			if subscribed == false && rec.Count == len(names)+len(patterns) {
+				subscribed = true
+				if reconnect {
+					ark.Warning("bus.redis.eventing", "resubscribed", len(names)+len(patterns)-1)
+				}
+			}
+		case redis.Pong:
 		case error:
-			break
+			return false, subscribed, rec
 		}
 	}
-
-	//取消定
-	psc.Unsubscribe(names...)
-
-	//无限循环
-	//connect.eventing()
 }
 
 //队列监听
@@ -329,25 +633,67 @@ func (connect *redisBusConnect) queueing(name string) {
 	names = append(names, 10)
 
 	conn := connect.client.Get()
-	defer conn.Close()
+	defer func() {
+		conn.Close()
+	}()
 
+	failures := 0
 	for {
-		bytes, _ := redis.ByteSlices(conn.Do("BRPOP", names...))
+		select {
+		case <-connect.queueStopper.ShouldStop():
+			return
+		default:
+		}
+
+		bytes, err := redis.ByteSlices(conn.Do("BRPOP", names...))
+		if err != nil && err != redis.ErrNil {
+			//连接断了，换一个连接
+			failures++
+			delay := redisBusBackoff(failures)
+			ark.Warning("bus.redis.queueing", name, "disconnected", delay, err)
+			if connect.sleep(connect.queueStopper, delay) == false {
+				return
+			}
+			conn.Close()
+			conn = connect.client.Get()
+			continue
+		}
+		if failures > 0 {
+			failures = 0
+			ark.Warning("bus.redis.queueing", name, "reconnected")
+		}
+
 		if bytes != nil && len(bytes) >= 2 {
 			channel := strings.Replace(string(bytes[0]), connect.config.Prefix, "", 1)
 			data := bytes[1]
-			if channel == connect.queueCloser {
-				break //退出
-			} else {
-				if call, ok := connect.queues[channel]; ok {
-					call.Handler(channel, data)
-				}
+			if channel == name+connect.queueCloser {
+				return //退出
 			}
+			connect.queued(channel, data)
 		}
 	}
+}
+
+//第failures次失败后的重连等待时间
+func redisBusBackoff(failures int) time.Duration {
+	delay := time.Second
+	for i := 1; i < failures && delay < redisBusMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > redisBusMaxBackoff {
+		delay = redisBusMaxBackoff
+	}
+	return delay
+}
 
-	//递归
-	//connect.queueing(name)
+//等待一段时间，期间要求停止返回false
+func (connect *redisBusConnect) sleep(stopper *util.Stopper, delay time.Duration) bool {
+	select {
+	case <-time.After(delay):
+		return true
+	case <-stopper.ShouldStop():
+		return false
+	}
 }
 
 //执行统一到这里
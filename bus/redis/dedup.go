@@ -0,0 +1,89 @@
+package bus_redis
+
+import (
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/arkgo/driver/kit"
+	"github.com/gomodule/redigo/redis"
+)
+
+//------------------------- 消息去重 begin --------------------------
+//按信封编号去重，只对生产者指定了编号的消息去重，自动生成的编号每条都不一样，不用去重
+//分两个状态
+//处理前用 SET NX 占位为处理中，时长为visibility的一半，节点崩溃了占位会自己过期
+//占位要比stream认领和分区租约的visibility短，崩溃后重新投递的消息不会被当成重复的确认掉
+//处理成功才改为已完成，保留去重窗口的时长；失败了删除占位，重试或生产者重发的还能处理
+//已完成或处理中的相同编号直接跳过
+
+const (
+	redisBusDedupKey        = "_bus_dedup:"
+	redisBusDedupProcessing = "processing"
+	redisBusDedupDone       = "done"
+)
+
+//处理中占位的时长，严格短于visibility
+func (connect *redisBusConnect) dedupHold() time.Duration {
+	hold := connect.setting.Visibility / 2
+	if hold < time.Millisecond {
+		hold = time.Millisecond
+	}
+	return hold
+}
+
+func (connect *redisBusConnect) dedupKey(name string, envelope kit.Envelope) string {
+	return connect.config.Prefix + redisBusDedupKey + name + ":" + envelope.Id
+}
+
+func (connect *redisBusConnect) dedupable(envelope kit.Envelope) bool {
+	return connect.setting.Dedup > 0 && envelope.Dedup && envelope.Id != ""
+}
+
+//是否重复的消息，不重复就占位，redis出错时按不重复处理，宁可多处理一次
+func (connect *redisBusConnect) duplicated(name string, envelope kit.Envelope) bool {
+	if connect.dedupable(envelope) == false {
+		return false
+	}
+
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	_, err := redis.String(conn.Do("SET", connect.dedupKey(name, envelope), redisBusDedupProcessing, "NX", "PX", connect.dedupHold().Milliseconds()))
+	if err == redis.ErrNil {
+		return true
+	}
+	if err != nil {
+		ark.Warning("bus.redis.dedup", name, err)
+	}
+	return false
+}
+
+//处理成功，去重窗口内不再处理
+func (connect *redisBusConnect) dedupDone(name string, envelope kit.Envelope) {
+	if connect.dedupable(envelope) == false {
+		return
+	}
+
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SET", connect.dedupKey(name, envelope), redisBusDedupDone, "PX", connect.setting.Dedup.Milliseconds()); err != nil {
+		ark.Warning("bus.redis.dedup", name, err)
+	}
+}
+
+//处理失败，取消占位
+func (connect *redisBusConnect) undedup(name string, envelope kit.Envelope) {
+	if connect.dedupable(envelope) == false {
+		return
+	}
+
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("DEL", connect.dedupKey(name, envelope)); err != nil {
+		ark.Warning("bus.redis.dedup", name, err)
+	}
+}
+
+//------------------------- 消息去重 end --------------------------
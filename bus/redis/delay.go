@@ -0,0 +1,115 @@
+package bus_redis
+
+import (
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/gomodule/redigo/redis"
+)
+
+//------------------------- 延时消息 begin --------------------------
+
+const (
+	redisBusDelayPublish   = "publish"
+	redisBusDelayList      = "list"
+	redisBusDelayStream    = "stream"
+	redisBusDelayPartition = "partition"
+
+	redisBusDelayKey      = "_bus_delay"      //有序集合，分数为到期毫秒时间
+	redisBusDelayDataKey  = "_bus_delay_data" //哈希，消息内容
+	redisBusDelayBatch    = 100
+	redisBusDelayInterval = time.Second
+)
+
+//到期消息的搬运在脚本内原子完成，多节点同时搬运也只会投递一次
+//成员格式为 类型|编号|名称，分区消息搬运后顺便唤醒分区线程
+var redisBusDelayScript = redis.NewScript(2, `
+local items = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[2]))
+for _, item in ipairs(items) do
+	local kind, id, name = string.match(item, '^(%a+)|([^|]+)|(.*)$')
+	redis.call('ZREM', KEYS[1], item)
+	if id then
+		local data = redis.call('HGET', KEYS[2], id)
+		redis.call('HDEL', KEYS[2], id)
+		if data then
+			local key = ARGV[3] .. name
+			if kind == 'publish' then
+				redis.call('PUBLISH', key, data)
+			elseif kind == 'stream' then
+				redis.call('XADD', key, '*', ARGV[4], data)
+			elseif kind == 'partition' then
+				redis.call('LPUSH', key, data)
+				local queue = string.match(name, '^(.*)' .. ARGV[5] .. '%d+$')
+				if queue then
+					local wake = ARGV[3] .. queue .. ARGV[6]
+					redis.call('LPUSH', wake, '')
+					redis.call('LTRIM', wake, 0, tonumber(ARGV[7]) - 1)
+				end
+			else
+				redis.call('LPUSH', key, data)
+			end
+		end
+	end
+end
+return #items
+`)
+
+//写入延时消息
+func (connect *redisBusConnect) delay(kind, name string, data []byte, delay time.Duration) error {
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	id := ark.Unique()
+	due := time.Now().Add(delay).UnixNano() / int64(time.Millisecond)
+	member := kind + "|" + id + "|" + name
+
+	conn.Send("MULTI")
+	conn.Send("HSET", connect.config.Prefix+redisBusDelayDataKey, id, data)
+	conn.Send("ZADD", connect.config.Prefix+redisBusDelayKey, due, member)
+	if _, err := conn.Do("EXEC"); err != nil {
+		ark.Warning("bus.redis.delay", err)
+		return err
+	}
+
+	return nil
+}
+
+//定时搬运到期的延时消息
+func (connect *redisBusConnect) delaying() {
+	ticker := time.NewTicker(redisBusDelayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			connect.delayed()
+		case <-connect.delayStopper.ShouldStop():
+			return
+		}
+	}
+}
+
+func (connect *redisBusConnect) delayed() {
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	for {
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		count, err := redis.Int(redisBusDelayScript.Do(
+			conn,
+			connect.config.Prefix+redisBusDelayKey, connect.config.Prefix+redisBusDelayDataKey,
+			now, redisBusDelayBatch, connect.config.Prefix, redisBusStreamField,
+			redisBusPartitionKey, redisBusPartitionWake, redisBusPartitionWakes,
+		))
+		if err != nil {
+			ark.Warning("bus.redis.delayed", err)
+			return
+		}
+		//不满一批，说明已经搬完了
+		if count < redisBusDelayBatch {
+			return
+		}
+	}
+}
+
+//------------------------- 延时消息 end --------------------------
@@ -0,0 +1,59 @@
+package bus_redis
+
+import (
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/arkgo/driver/kit"
+)
+
+//------------------------- 消息信封 begin --------------------------
+//发布和入队的消息都包在信封里，带上编号、头信息、重试次数和入队时间
+//信封加前缀和裸消息区分，读取时两种都能解析
+//
+//滚动升级时，旧版本的节点不认识信封，可以先把 envelope 设为 false
+//这时 Publish 和 Enqueue 直接写裸消息，新旧节点都能处理，全部升级后再打开
+//PublishEnvelope、EnqueueEnvelope 和失败重试的消息总是带信封，重试次数要记在信封里
+
+//注册带信封的回调，注册后处理器拿到完整信封，返回错误视为处理失败
+func (connect *redisBusConnect) AcceptEnvelope(eventHandler, queueHandler kit.EnvelopeHandler) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	connect.envelopeEventHandler = eventHandler
+	connect.envelopeQueueHandler = queueHandler
+
+	return nil
+}
+
+//发布带信封的消息，编号和时间为空时自动生成
+func (connect *redisBusConnect) PublishEnvelope(name string, envelope kit.Envelope, delays ...time.Duration) error {
+	if connect.client == nil {
+		return ark.Fail
+	}
+	if connect.isClosed() {
+		return errRedisBusClosed
+	}
+	data, err := kit.EncodeEnvelope(kit.SealEnvelope(envelope))
+	if err != nil {
+		return err
+	}
+	return connect.publish(name, data, delays...)
+}
+
+//入队带信封的消息，编号和时间为空时自动生成
+func (connect *redisBusConnect) EnqueueEnvelope(name string, envelope kit.Envelope, delays ...time.Duration) error {
+	if connect.client == nil {
+		return ark.Fail
+	}
+	if connect.isClosed() {
+		return errRedisBusClosed
+	}
+	data, err := kit.EncodeEnvelope(kit.SealEnvelope(envelope))
+	if err != nil {
+		return err
+	}
+	return connect.route(name, envelope, data, delays...)
+}
+
+//------------------------- 消息信封 end --------------------------
@@ -0,0 +1,143 @@
+package bus_redis
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/arkgo/driver/kit"
+	"github.com/gomodule/redigo/redis"
+)
+
+//------------------------- 队列查看 begin --------------------------
+//排队数和最早消息从redis里查，整个集群共用；处理中的数量是本节点的
+
+//查看队列，不指定就是本连接注册的全部队列
+func (connect *redisBusConnect) Inspect(names ...string) ([]kit.QueueStats, error) {
+	connect.mutex.RLock()
+	if len(names) == 0 {
+		for name, _ := range connect.queues {
+			names = append(names, name)
+		}
+	}
+	queues := make(map[string]redisBusQueue, len(names))
+	for _, name := range names {
+		queues[name] = connect.queues[name]
+	}
+	connect.mutex.RUnlock()
+	sort.Strings(names)
+
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	now := time.Now()
+	stats := make([]kit.QueueStats, 0, len(names))
+	for _, name := range names {
+		stat := kit.QueueStats{Name: name}
+		if queue, ok := queues[name]; ok {
+			stat.Workers = queue.Thread
+			if queue.Actives != nil {
+				stat.Actives = atomic.LoadInt64(queue.Actives)
+			}
+		}
+
+		length, oldest, err := connect.inspect(conn, name, now)
+		if err != nil {
+			return nil, err
+		}
+		stat.Length, stat.Oldest = length, oldest
+
+		if connect.setting.Mode == redisBusModeStream {
+			pending, err := redis.Values(conn.Do("XPENDING", connect.config.Prefix+name, connect.setting.Group))
+			if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") == false {
+				return nil, err
+			}
+			if len(pending) > 0 {
+				stat.Pending, _ = redis.Int64(pending[0], nil)
+			}
+		}
+
+		if retry := connect.setting.Retries.Queue(name); retry.Deadletter != "" {
+			deadletter, _, err := connect.inspect(conn, retry.Deadletter, now)
+			if err != nil {
+				return nil, err
+			}
+			stat.Deadletter = deadletter
+		}
+
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+//队列的排队数和最早消息的等待时间，分区一起算
+func (connect *redisBusConnect) inspect(conn redis.Conn, name string, now time.Time) (int64, time.Duration, error) {
+	realName := connect.config.Prefix + name
+
+	length, oldest := int64(0), time.Duration(0)
+	ages := func(data []byte) {
+		envelope := kit.DecodeEnvelope(data)
+		if envelope.Time.IsZero() == false && now.Sub(envelope.Time) > oldest {
+			oldest = now.Sub(envelope.Time)
+		}
+	}
+
+	if connect.setting.Mode == redisBusModeStream {
+		count, err := redis.Int64(conn.Do("XLEN", realName))
+		if err != nil {
+			return 0, 0, err
+		}
+		length += count
+
+		reply, err := conn.Do("XRANGE", realName, "-", "+", "COUNT", 1)
+		if err != nil {
+			return 0, 0, err
+		}
+		msgs, err := redisBusStreamEntries(reply)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, msg := range msgs {
+			ages(msg.Data)
+		}
+	} else {
+		conn.Send("LLEN", realName)
+		conn.Send("LINDEX", realName, -1)
+	}
+
+	//分区都是列表，队尾是最早的
+	for i := 0; i < connect.partitions(name); i++ {
+		key := realName + redisBusPartitionKey + strconv.Itoa(i)
+		conn.Send("LLEN", key)
+		conn.Send("LINDEX", key, -1)
+	}
+	if err := conn.Flush(); err != nil {
+		return 0, 0, err
+	}
+
+	lists := connect.partitions(name)
+	if connect.setting.Mode != redisBusModeStream {
+		lists++
+	}
+	for i := 0; i < lists; i++ {
+		count, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return 0, 0, err
+		}
+		data, err := redis.Bytes(conn.Receive())
+		if err != nil && err != redis.ErrNil {
+			return 0, 0, err
+		}
+		length += count
+		if data != nil {
+			ages(data)
+		}
+	}
+
+	return length, oldest, nil
+}
+
+//------------------------- 队列查看 end --------------------------
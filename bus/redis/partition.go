@@ -0,0 +1,333 @@
+package bus_redis
+
+import (
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/arkgo/ark"
+	. "github.com/arkgo/asset"
+	"github.com/arkgo/driver/kit"
+	"github.com/gomodule/redigo/redis"
+)
+
+//------------------------- 分区队列 begin --------------------------
+//带分区键的消息按键哈希写入队列的分区列表，不管list还是stream模式都走列表
+//每个分区同一时间只被一个线程持有，持有期间按顺序逐条处理，不同分区并行
+//先看后删，处理完成才从列表移除，线程崩溃时租约过期，其它线程接着处理
+//只有配置了分区数的队列才启动分区线程，写入时推一个唤醒消息，空闲时阻塞等唤醒
+
+const (
+	redisBusPartitionKey   = ":_partition:"
+	redisBusPartitionWake  = ":_partition_wake"
+	redisBusPartitionLock  = "_bus_partition:"
+	redisBusPartitionBatch = 100 //持有一个分区最多连续处理的数量，处理完让出
+	redisBusPartitionWakes = 16  //唤醒消息最多留多少个，多了也只是多扫一遍
+)
+
+var (
+	//还持有租约才移除消息并续租
+	redisBusPartitionAckScript = redis.NewScript(2, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('RPOP', KEYS[2])
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+	redisBusPartitionRenewScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+	redisBusPartitionUnlockScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+)
+
+type (
+	redisBusPartition struct {
+		list  string //分区列表，不带前缀
+		lock  string //分区租约，带前缀
+		token string
+	}
+)
+
+//分区配置，partitions是默认分区数，queues下可以按队列配置
+func redisBusPartitionSetting(config Map) (int, map[string]int) {
+	partitions, partitioned := 0, make(map[string]int, 0)
+	if vv, ok := config["partitions"].(int64); ok && vv >= 0 {
+		partitions = int(vv)
+	}
+	if vvs, ok := config["queues"].(Map); ok {
+		for name, vv := range vvs {
+			if queue, ok := vv.(Map); ok {
+				if count, ok := queue["partitions"].(int64); ok && count >= 0 {
+					partitioned[name] = int(count)
+				}
+			}
+		}
+	}
+	return partitions, partitioned
+}
+
+//队列的分区数，按队列的配置优先
+func (connect *redisBusConnect) partitions(name string) int {
+	if count, ok := connect.setting.Partitioned[name]; ok {
+		return count
+	}
+	return connect.setting.Partitions
+}
+
+//分区列表名
+func (connect *redisBusConnect) partition(name, key string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	index := hash.Sum32() % uint32(connect.partitions(name))
+	return name + redisBusPartitionKey + strconv.FormatUint(uint64(index), 10)
+}
+
+//入队，有分区键并且队列分了区的写入分区列表
+func (connect *redisBusConnect) route(name string, envelope kit.Envelope, data []byte, delays ...time.Duration) error {
+	if envelope.Key == "" || connect.partitions(name) <= 0 {
+		return connect.enqueue(name, data, delays...)
+	}
+
+	list := connect.partition(name, envelope.Key)
+	if len(delays) > 0 && delays[0] > 0 {
+		return connect.delay(redisBusDelayPartition, list, data, delays[0])
+	}
+
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	wake := connect.config.Prefix + name + redisBusPartitionWake
+	conn.Send("LPUSH", connect.config.Prefix+list, data)
+	conn.Send("LPUSH", wake, "")
+	conn.Send("LTRIM", wake, 0, redisBusPartitionWakes-1)
+	if _, err := conn.Do(""); err != nil {
+		ark.Warning("bus.redis.enqueue", err)
+		return err
+	}
+	return nil
+}
+
+//分区线程，轮流检查各分区，抢到租约的分区按顺序处理
+//都空闲时阻塞等唤醒，超时也扫一遍，接手租约过期的分区和搬运过来的延时消息
+func (connect *redisBusConnect) partitioning(name string) {
+	token := ark.Unique(connect.consumer)
+	wake := connect.config.Prefix + name + redisBusPartitionWake
+	closer := connect.config.Prefix + name + redisBusPartitionKey + connect.queueCloser
+	timeout := redisBusPopTimeout(connect.setting.Visibility)
+
+	conn := connect.client.Get()
+	defer func() {
+		conn.Close()
+	}()
+
+	offset, failures := 0, 0
+	for {
+		select {
+		case <-connect.queueStopper.ShouldStop():
+			return
+		default:
+		}
+
+		busy, err := connect.partitioned(conn, name, token, offset)
+		if err == nil && busy == false {
+			var reply []string
+			reply, err = redis.Strings(conn.Do("BRPOP", wake, closer, timeout))
+			if err == redis.ErrNil {
+				err = nil //超时
+			} else if err == nil && len(reply) > 0 && reply[0] == closer {
+				return //退出
+			}
+		}
+		if err != nil {
+			failures++
+			delay := redisBusBackoff(failures)
+			ark.Warning("bus.redis.partition", name, "disconnected", delay, err)
+			if connect.sleep(connect.queueStopper, delay) == false {
+				return
+			}
+			conn.Close()
+			conn = connect.client.Get()
+			continue
+		}
+		if failures > 0 {
+			failures = 0
+			ark.Warning("bus.redis.partition", name, "reconnected")
+		}
+		offset++
+	}
+}
+
+//扫一遍各分区，一次批量取长度，有消息的抢租约处理，返回是否处理过
+func (connect *redisBusConnect) partitioned(conn redis.Conn, name, token string, offset int) (bool, error) {
+	count := connect.partitions(name)
+	lists := make([]string, count)
+	for i := 0; i < count; i++ {
+		lists[i] = name + redisBusPartitionKey + strconv.Itoa((offset+i)%count)
+		conn.Send("LLEN", connect.config.Prefix+lists[i])
+	}
+	if err := conn.Flush(); err != nil {
+		return false, err
+	}
+	lengths := make([]int, count)
+	for i := 0; i < count; i++ {
+		length, err := redis.Int(conn.Receive())
+		if err != nil {
+			return false, err
+		}
+		lengths[i] = length
+	}
+
+	busy := false
+	for i, list := range lists {
+		select {
+		case <-connect.queueStopper.ShouldStop():
+			return busy, nil
+		default:
+		}
+		if lengths[i] == 0 {
+			continue
+		}
+
+		partition := redisBusPartition{list, connect.config.Prefix + redisBusPartitionLock + list, token}
+		_, err := redis.String(conn.Do("SET", partition.lock, token, "NX", "PX", connect.setting.Visibility.Milliseconds()))
+		if err == redis.ErrNil {
+			continue //别的线程持有
+		}
+		if err != nil {
+			return busy, err
+		}
+
+		busy = true
+		connect.sequence(conn, name, partition)
+		redisBusPartitionUnlockScript.Do(conn, partition.lock, token)
+	}
+	return busy, nil
+}
+
+//按顺序处理分区里的消息，租约丢了就停下
+func (connect *redisBusConnect) sequence(conn redis.Conn, name string, partition redisBusPartition) {
+	realList := connect.config.Prefix + partition.list
+	for i := 0; i < redisBusPartitionBatch; i++ {
+		select {
+		case <-connect.queueStopper.ShouldStop():
+			return
+		default:
+		}
+
+		data, err := redis.Bytes(conn.Do("LINDEX", realList, -1))
+		if err != nil {
+			if err != redis.ErrNil {
+				ark.Warning("bus.redis.partition", name, err)
+			}
+			return
+		}
+
+		//处理和重试等待期间一直续租，处理时间超过visibility也不会被别的线程抢走
+		stop := connect.watch(partition)
+		ok := connect.sequenced(name, partition, data)
+		stop()
+		if ok == false {
+			return
+		}
+
+		acked, err := redis.Int(redisBusPartitionAckScript.Do(conn, partition.lock, realList, partition.token, connect.setting.Visibility.Milliseconds()))
+		if err != nil || acked == 0 {
+			ark.Warning("bus.redis.partition", name, "lease lost", err)
+			return
+		}
+	}
+}
+
+//处理分区消息，失败了原地重试，保证同一个键的后续消息不会越过它
+//重试中途要求停止返回false，消息留在分区里下次接着处理
+func (connect *redisBusConnect) sequenced(name string, partition redisBusPartition, data []byte) bool {
+	call, ok := connect.queues[name]
+	if ok == false {
+		return true
+	}
+
+	envelope := kit.DecodeEnvelope(data)
+	if connect.duplicated(name, envelope) {
+		ark.Warning("bus.redis.duplicate", name, envelope.Id)
+		return true
+	}
+
+	retry := connect.setting.Retries.Queue(name)
+	for {
+		err := kit.Handle(func() error {
+			return call.Handler(name, envelope)
+		}, &connect.actives, call.Actives)
+		if err == nil {
+			connect.dedupDone(name, envelope)
+			return true
+		}
+
+		envelope.Attempt++
+		if envelope.Attempt > retry.Retry {
+			break
+		}
+
+		if connect.sleep(connect.queueStopper, retry.Delay(envelope.Attempt)) == false {
+			connect.undedup(name, envelope)
+			return false
+		}
+	}
+
+	//彻底失败了取消占位，生产者重发的还要能处理
+	connect.undedup(name, envelope)
+
+	encoded, err := kit.EncodeEnvelope(kit.SealEnvelope(envelope))
+	if err != nil {
+		ark.Warning("bus.redis.retry", name, err)
+		return true
+	}
+	if retry.Deadletter != "" {
+		if err := connect.route(retry.Deadletter, envelope, encoded); err != nil {
+			ark.Warning("bus.redis.deadletter", name, err)
+		}
+	} else {
+		ark.Warning("bus.redis.dropped", name, envelope.Attempt)
+	}
+	return true
+}
+
+//定时续租，每visibility的三分之一续一次，返回停止续租的函数
+func (connect *redisBusConnect) watch(partition redisBusPartition) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(connect.setting.Visibility / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				connect.renew(partition, connect.setting.Visibility)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+//续租
+func (connect *redisBusConnect) renew(partition redisBusPartition, expiry time.Duration) {
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	if _, err := redisBusPartitionRenewScript.Do(conn, partition.lock, partition.token, expiry.Milliseconds()); err != nil {
+		ark.Warning("bus.redis.partition", partition.list, err)
+	}
+}
+
+//------------------------- 分区队列 end --------------------------
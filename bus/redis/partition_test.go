@@ -0,0 +1,37 @@
+package bus_redis
+
+import (
+	"testing"
+
+	. "github.com/arkgo/asset"
+)
+
+func TestRedisBusPartitionSetting(t *testing.T) {
+	partitions, partitioned := redisBusPartitionSetting(Map{})
+	if partitions != 0 || len(partitioned) != 0 {
+		t.Fatalf("default: got %d %v", partitions, partitioned)
+	}
+
+	partitions, partitioned = redisBusPartitionSetting(Map{
+		"partitions": int64(4),
+		"queues": Map{
+			"order": Map{"partitions": int64(16)},
+			"mail":  Map{"partitions": int64(0)},
+			"bad":   "x",
+		},
+	})
+	if partitions != 4 {
+		t.Fatalf("partitions: got %d", partitions)
+	}
+	if partitioned["order"] != 16 || len(partitioned) != 2 {
+		t.Fatalf("partitioned: got %v", partitioned)
+	}
+
+	connect := &redisBusConnect{setting: redisBusSetting{Partitions: partitions, Partitioned: partitioned}}
+	if connect.partitions("order") != 16 || connect.partitions("mail") != 0 || connect.partitions("other") != 4 {
+		t.Fatalf("per queue partitions wrong")
+	}
+	if a, b := connect.partition("order", "user-1"), connect.partition("order", "user-1"); a != b {
+		t.Fatalf("partition not stable: %s %s", a, b)
+	}
+}
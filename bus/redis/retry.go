@@ -0,0 +1,58 @@
+package bus_redis
+
+import (
+	"github.com/arkgo/ark"
+	"github.com/arkgo/driver/kit"
+)
+
+//------------------------- 重试和死信 begin --------------------------
+
+//处理队列消息，失败了按策略重试或转入死信
+func (connect *redisBusConnect) queued(name string, data []byte) {
+	call, ok := connect.queues[name]
+	if ok == false {
+		return
+	}
+
+	envelope := kit.DecodeEnvelope(data)
+	if connect.duplicated(name, envelope) {
+		ark.Warning("bus.redis.duplicate", name, envelope.Id)
+		return
+	}
+
+	err := kit.Handle(func() error {
+		return call.Handler(name, envelope)
+	}, &connect.actives, call.Actives)
+	if err == nil {
+		connect.dedupDone(name, envelope)
+		return
+	}
+
+	//失败了取消占位，重试的消息还要能处理
+	connect.undedup(name, envelope)
+
+	retry := connect.setting.Retries.Queue(name)
+	envelope.Attempt++
+
+	//裸消息重试时也包上信封，才能记住次数
+	encoded, err := kit.EncodeEnvelope(kit.SealEnvelope(envelope))
+	if err != nil {
+		ark.Warning("bus.redis.retry", name, err)
+		return
+	}
+
+	if envelope.Attempt <= retry.Retry {
+		//延时重新入队，由redis保存，任意节点都可以接着处理
+		if err := connect.enqueue(name, encoded, retry.Delay(envelope.Attempt)); err != nil {
+			ark.Warning("bus.redis.retry", name, err)
+		}
+	} else if retry.Deadletter != "" {
+		if err := connect.route(retry.Deadletter, envelope, encoded); err != nil {
+			ark.Warning("bus.redis.deadletter", name, err)
+		}
+	} else {
+		ark.Warning("bus.redis.dropped", name, envelope.Attempt)
+	}
+}
+
+//------------------------- 重试和死信 end --------------------------
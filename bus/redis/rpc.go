@@ -0,0 +1,200 @@
+package bus_redis
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/arkgo/driver/kit"
+	"github.com/gomodule/redigo/redis"
+)
+
+//------------------------- 请求应答 begin --------------------------
+//请求写入 _bus_request:名称 列表，由任意节点的应答线程取出处理
+//应答写入请求自带的 _bus_reply:编号 列表，请求方阻塞等待，超时即放弃
+
+const (
+	redisBusRequestKey = "_bus_request:"
+	redisBusReplyKey   = "_bus_reply:"
+	redisBusRespondPop = 5 //应答线程BRPOP的秒数，到时检查是否需要退出
+)
+
+var (
+	errRedisBusTimeout = errors.New("请求超时")
+)
+
+type (
+	//处理请求，返回值作为应答
+	redisBusResponder struct {
+		Thread  int
+		Handler kit.RespondHandler
+	}
+	redisBusRequest struct {
+		Id     string `json:"id"`
+		Reply  string `json:"reply"`
+		Expiry int64  `json:"expiry"` //过期的毫秒时间，过期的请求不再处理
+		Data   []byte `json:"data"`
+	}
+	redisBusReply struct {
+		Id    string `json:"id"`
+		Data  []byte `json:"data"`
+		Error string `json:"error,omitempty"`
+	}
+)
+
+//注册应答，Start之后开始处理
+func (connect *redisBusConnect) Respond(name string, thread int, handler kit.RespondHandler) error {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	if thread <= 0 {
+		thread = 1
+	}
+	connect.responders[name] = redisBusResponder{thread, handler}
+
+	return nil
+}
+
+//发起请求，等待应答
+func (connect *redisBusConnect) Request(name string, data []byte, timeout time.Duration) ([]byte, error) {
+	if connect.client == nil {
+		return nil, ark.Fail
+	}
+	if connect.isClosed() {
+		return nil, errRedisBusClosed
+	}
+	if timeout <= 0 {
+		return nil, kit.ErrInvalidTimeout
+	}
+
+	now := time.Now()
+	id := ark.Unique()
+	req := redisBusRequest{
+		Id: id, Reply: connect.config.Prefix + redisBusReplyKey + id,
+		Expiry: now.Add(timeout).UnixNano() / int64(time.Millisecond), Data: data,
+	}
+	bytes, err := ark.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("LPUSH", connect.config.Prefix+redisBusRequestKey+name, bytes); err != nil {
+		ark.Warning("bus.redis.request", err)
+		return nil, err
+	}
+
+	vals, err := redis.ByteSlices(conn.Do("BRPOP", req.Reply, redisBusPopTimeout(timeout)))
+	if err == redis.ErrNil {
+		return nil, errRedisBusTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) < 2 {
+		return nil, errRedisBusTimeout
+	}
+
+	reply := redisBusReply{}
+	if err := ark.Unmarshal(vals[1], &reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return reply.Data, errors.New(reply.Error)
+	}
+	return reply.Data, nil
+}
+
+//应答线程
+func (connect *redisBusConnect) responding(name string) {
+	key := connect.config.Prefix + redisBusRequestKey + name
+
+	conn := connect.client.Get()
+	defer func() {
+		conn.Close()
+	}()
+
+	failures := 0
+	for {
+		select {
+		case <-connect.queueStopper.ShouldStop():
+			return
+		default:
+		}
+
+		vals, err := redis.ByteSlices(conn.Do("BRPOP", key, redisBusRespondPop))
+		if err != nil && err != redis.ErrNil {
+			failures++
+			delay := redisBusBackoff(failures)
+			ark.Warning("bus.redis.responding", name, "disconnected", delay, err)
+			if connect.sleep(connect.queueStopper, delay) == false {
+				return
+			}
+			conn.Close()
+			conn = connect.client.Get()
+			continue
+		}
+		failures = 0
+
+		if len(vals) >= 2 {
+			connect.respond(conn, name, vals[1])
+		}
+	}
+}
+
+//处理一个请求，把应答写回请求方
+func (connect *redisBusConnect) respond(conn redis.Conn, name string, data []byte) {
+	responder, ok := connect.responders[name]
+	if ok == false {
+		return
+	}
+
+	req := redisBusRequest{}
+	if err := ark.Unmarshal(data, &req); err != nil {
+		ark.Warning("bus.redis.respond", name, err)
+		return
+	}
+
+	//请求方已经放弃了
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if req.Expiry < now {
+		return
+	}
+
+	//panic视为失败，处理中的也算进活跃数，关闭时等它完成
+	reply := redisBusReply{Id: req.Id}
+	err := kit.Handle(func() error {
+		data, err := responder.Handler(name, req.Data)
+		reply.Data = data
+		return err
+	}, &connect.actives)
+	if err != nil {
+		reply.Error = err.Error()
+	}
+
+	bytes, err := ark.Marshal(reply)
+	if err != nil {
+		ark.Warning("bus.redis.respond", name, err)
+		return
+	}
+
+	//请求方超时后，应答不要一直留着
+	conn.Send("LPUSH", req.Reply, bytes)
+	conn.Send("PEXPIRE", req.Reply, req.Expiry-now+1000)
+	if _, err := conn.Do(""); err != nil {
+		ark.Warning("bus.redis.respond", name, err)
+	}
+}
+
+//BRPOP的超时秒数，redis 6开始支持小数，精确到毫秒
+func redisBusPopTimeout(timeout time.Duration) string {
+	if timeout < time.Millisecond {
+		timeout = time.Millisecond
+	}
+	return strconv.FormatFloat(timeout.Seconds(), 'f', 3, 64)
+}
+
+//------------------------- 请求应答 end --------------------------
@@ -0,0 +1,20 @@
+package bus_redis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRedisBusPopTimeout(t *testing.T) {
+	cases := map[time.Duration]string{
+		250 * time.Millisecond:  "0.250",
+		1500 * time.Millisecond: "1.500",
+		2 * time.Second:         "2.000",
+		time.Microsecond:        "0.001",
+	}
+	for timeout, want := range cases {
+		if got := redisBusPopTimeout(timeout); got != want {
+			t.Errorf("%v: got %s want %s", timeout, got, want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package bus_redis
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/arkgo/driver/kit"
+	"github.com/gomodule/redigo/redis"
+)
+
+//------------------------- 定时消息 begin --------------------------
+//每个节点都注册同样的定时任务，由选出的主节点触发，同一时刻只有一个节点发布
+//所有节点都按本地时间推进下一次时间，主节点切换时不会补发之前的
+//主节点切换的瞬间新旧节点可能都认为自己是主节点，每个时间点发布前先占一个标记，同一时间点只发一次
+
+const (
+	redisBusScheduleKey      = "_bus_scheduler" //主节点，值为节点的消费者名
+	redisBusScheduleTickKey  = "_bus_schedule:" //时间点标记
+	redisBusScheduleTick     = time.Minute      //时间点标记保留的时长
+	redisBusScheduleLease    = time.Second * 5
+	redisBusScheduleInterval = time.Second
+)
+
+var (
+	//续任主节点，不是主节点时尝试成为主节点
+	redisBusScheduleScript = redis.NewScript(1, `
+local leader = redis.call('GET', KEYS[1])
+if leader == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+if not leader then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0
+`)
+)
+
+type (
+	redisBusSchedule struct {
+		Kind string //publish 或 enqueue
+		Name string
+		Data []byte
+		Spec string
+		cron *kit.Cron
+		next time.Time
+	}
+)
+
+//定时发布事件
+func (connect *redisBusConnect) SchedulePublish(spec, name string, data []byte) error {
+	return connect.schedule(redisBusDelayPublish, spec, name, data)
+}
+
+//定时入队
+func (connect *redisBusConnect) ScheduleEnqueue(spec, name string, data []byte) error {
+	return connect.schedule(redisBusDelayList, spec, name, data)
+}
+
+func (connect *redisBusConnect) schedule(kind, spec, name string, data []byte) error {
+	cron, err := kit.ParseCron(spec)
+	if err != nil {
+		return err
+	}
+
+	schedule := &redisBusSchedule{Kind: kind, Name: name, Data: data, Spec: spec, cron: cron}
+	schedule.next = cron.Next(time.Now())
+
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+	connect.schedules = append(connect.schedules, schedule)
+
+	return nil
+}
+
+//定时检查到期的任务
+func (connect *redisBusConnect) scheduling() {
+	ticker := time.NewTicker(redisBusScheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			connect.scheduled(now)
+		case <-connect.delayStopper.ShouldStop():
+			return
+		}
+	}
+}
+
+//触发到期的任务，只有主节点真正发布
+func (connect *redisBusConnect) scheduled(now time.Time) {
+	connect.mutex.RLock()
+	schedules := connect.schedules
+	connect.mutex.RUnlock()
+	if len(schedules) == 0 {
+		return
+	}
+
+	leader := connect.leader()
+	for _, schedule := range schedules {
+		if schedule.next.IsZero() || now.Before(schedule.next) {
+			continue
+		}
+		if leader && connect.ticked(schedule, schedule.next) {
+			connect.fire(schedule)
+		}
+		schedule.next = schedule.cron.Next(now)
+	}
+}
+
+//是否主节点
+func (connect *redisBusConnect) leader() bool {
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	leader, err := redis.Int(redisBusScheduleScript.Do(conn, connect.config.Prefix+redisBusScheduleKey, connect.consumer, redisBusScheduleLease.Milliseconds()))
+	if err != nil {
+		ark.Warning("bus.redis.schedule", err)
+		return false
+	}
+	return leader == 1
+}
+
+//占用时间点标记，占到了才发布
+func (connect *redisBusConnect) ticked(schedule *redisBusSchedule, tick time.Time) bool {
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	key := connect.config.Prefix + redisBusScheduleTickKey + schedule.Kind + ":" + schedule.Name + ":" + schedule.Spec + ":" + strconv.FormatInt(tick.UnixNano()/int64(time.Millisecond), 10)
+	_, err := redis.String(conn.Do("SET", key, connect.consumer, "NX", "PX", redisBusScheduleTick.Milliseconds()))
+	if err == redis.ErrNil {
+		return false
+	}
+	if err != nil {
+		ark.Warning("bus.redis.schedule", schedule.Name, err)
+		return false
+	}
+	return true
+}
+
+func (connect *redisBusConnect) fire(schedule *redisBusSchedule) {
+	envelope := kit.SealEnvelope(kit.Envelope{
+		Headers: map[string]string{"schedule": schedule.Spec}, Data: schedule.Data,
+	})
+	data, err := kit.EncodeEnvelope(envelope)
+	if err != nil {
+		ark.Warning("bus.redis.schedule", schedule.Name, err)
+		return
+	}
+
+	if schedule.Kind == redisBusDelayPublish {
+		err = connect.publish(schedule.Name, data)
+	} else {
+		err = connect.enqueue(schedule.Name, data)
+	}
+	if err != nil {
+		ark.Warning("bus.redis.schedule", schedule.Name, err)
+	}
+}
+
+//------------------------- 定时消息 end --------------------------
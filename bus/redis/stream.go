@@ -0,0 +1,197 @@
+package bus_redis
+
+import (
+	"strings"
+
+	"github.com/arkgo/ark"
+	"github.com/gomodule/redigo/redis"
+)
+
+//------------------------- stream队列 begin --------------------------
+
+const (
+	redisBusModeList   = "list"
+	redisBusModeStream = "stream"
+
+	redisBusStreamField = "data"
+	redisBusStreamBlock = 5000 //XREADGROUP阻塞毫秒数，到时检查是否需要退出
+)
+
+type (
+	redisBusStreamMessage struct {
+		Id   string
+		Data []byte
+	}
+)
+
+//创建消费组，已存在则忽略
+func (connect *redisBusConnect) streamGroup(conn redis.Conn, realName string) error {
+	_, err := conn.Do("XGROUP", "CREATE", realName, connect.setting.Group, "0", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") == false {
+		return err
+	}
+	return nil
+}
+
+//stream队列监听
+//消息确认后才删除，处理中崩溃的消息，超过visibility后由其它线程认领重新处理
+func (connect *redisBusConnect) streaming(name string) {
+	realName := connect.config.Prefix + name
+
+	conn := connect.client.Get()
+	defer func() {
+		conn.Close()
+	}()
+
+	if err := connect.streamGroup(conn, realName); err != nil {
+		ark.Warning("bus.redis.group", err)
+	}
+
+	failures := 0
+	for {
+		select {
+		case <-connect.queueStopper.ShouldStop():
+			return
+		default:
+		}
+
+		msgs, err := connect.streamClaim(conn, realName)
+		if err == nil && len(msgs) == 0 {
+			msgs, err = connect.streamRead(conn, realName)
+		}
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				//stream被删除，重建消费组
+				connect.streamGroup(conn, realName)
+				continue
+			}
+
+			failures++
+			delay := redisBusBackoff(failures)
+			ark.Warning("bus.redis.stream", name, "disconnected", delay, err)
+			if connect.sleep(connect.queueStopper, delay) == false {
+				return
+			}
+			//连接出错了换一个，重建消费组以防redis是新的
+			if conn.Err() != nil {
+				conn.Close()
+				conn = connect.client.Get()
+			}
+			connect.streamGroup(conn, realName)
+			continue
+		}
+		if failures > 0 {
+			failures = 0
+			ark.Warning("bus.redis.stream", name, "reconnected")
+		}
+
+		for _, msg := range msgs {
+			if msg.Data != nil {
+				connect.queued(name, msg.Data)
+			}
+			//处理完成才确认
+			if _, err := conn.Do("XACK", realName, connect.setting.Group, msg.Id); err != nil {
+				ark.Warning("bus.redis.ack", err)
+				continue
+			}
+			conn.Do("XDEL", realName, msg.Id)
+		}
+	}
+}
+
+//认领超时未确认的消息
+func (connect *redisBusConnect) streamClaim(conn redis.Conn, realName string) ([]redisBusStreamMessage, error) {
+	idle := connect.setting.Visibility.Milliseconds()
+	vals, err := redis.Values(conn.Do("XAUTOCLAIM", realName, connect.setting.Group, connect.consumer, idle, "0-0", "COUNT", 1))
+	if err != nil {
+		return nil, err
+	}
+	return redisBusStreamClaimed(vals)
+}
+
+//解析 XAUTOCLAIM 的返回 [下一个游标, [消息...], [已删除的编号...]]
+//redis 7 开始已删除的消息不在消息列表里，单独放在第三项，也当作没有内容的消息返回，确认掉
+func redisBusStreamClaimed(vals []interface{}) ([]redisBusStreamMessage, error) {
+	if len(vals) < 2 {
+		return nil, nil
+	}
+	msgs, err := redisBusStreamEntries(vals[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) > 2 {
+		ids, err := redis.Strings(vals[2], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			msgs = append(msgs, redisBusStreamMessage{Id: id})
+		}
+	}
+	return msgs, nil
+}
+
+//读取新消息
+func (connect *redisBusConnect) streamRead(conn redis.Conn, realName string) ([]redisBusStreamMessage, error) {
+	vals, err := redis.Values(conn.Do(
+		"XREADGROUP", "GROUP", connect.setting.Group, connect.consumer,
+		"COUNT", 1, "BLOCK", redisBusStreamBlock, "STREAMS", realName, ">",
+	))
+	if err == redis.ErrNil {
+		return nil, nil //超时没有消息
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := []redisBusStreamMessage{}
+	for _, val := range vals {
+		stream, err := redis.Values(val, nil)
+		if err != nil || len(stream) < 2 {
+			continue
+		}
+		entries, err := redisBusStreamEntries(stream[1])
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, entries...)
+	}
+	return msgs, nil
+}
+
+//解析 [[id, [field, value, ...]], ...]
+func redisBusStreamEntries(reply interface{}) ([]redisBusStreamMessage, error) {
+	entries, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := []redisBusStreamMessage{}
+	for _, entry := range entries {
+		vals, err := redis.Values(entry, nil)
+		if err != nil || len(vals) < 2 {
+			continue
+		}
+		id, err := redis.String(vals[0], nil)
+		if err != nil {
+			continue
+		}
+		fields, err := redis.ByteSlices(vals[1], nil)
+		if err != nil {
+			//消息已被删除，字段为nil，确认掉即可
+			msgs = append(msgs, redisBusStreamMessage{Id: id})
+			continue
+		}
+
+		msg := redisBusStreamMessage{Id: id}
+		for i := 0; i+1 < len(fields); i += 2 {
+			if string(fields[i]) == redisBusStreamField {
+				msg.Data = fields[i+1]
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+//------------------------- stream队列 end --------------------------
@@ -0,0 +1,61 @@
+package bus_redis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRedisBusStreamClaimed(t *testing.T) {
+	//redis 7 的返回，第三项是已经删除的编号
+	vals := []interface{}{
+		[]byte("0-0"),
+		[]interface{}{
+			[]interface{}{[]byte("1-0"), []interface{}{[]byte("data"), []byte("hello")}},
+		},
+		[]interface{}{[]byte("2-0"), []byte("3-0")},
+	}
+
+	msgs, err := redisBusStreamClaimed(vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages, want 3", len(msgs))
+	}
+	if msgs[0].Id != "1-0" || string(msgs[0].Data) != "hello" {
+		t.Errorf("got %s %q", msgs[0].Id, msgs[0].Data)
+	}
+	for _, msg := range msgs[1:] {
+		if msg.Data != nil {
+			t.Errorf("deleted %s should have no data", msg.Id)
+		}
+	}
+}
+
+func TestRedisBusStreamClaimedLegacy(t *testing.T) {
+	//redis 6.2 没有第三项，已删除的消息字段为nil
+	vals := []interface{}{
+		[]byte("0-0"),
+		[]interface{}{
+			[]interface{}{[]byte("1-0"), nil},
+		},
+	}
+
+	msgs, err := redisBusStreamClaimed(vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Id != "1-0" || msgs[0].Data != nil {
+		t.Fatalf("got %+v", msgs)
+	}
+}
+
+func TestRedisBusDedupHold(t *testing.T) {
+	//去重占位要比认领的空闲时间短，崩溃后重新投递的消息不会被当成重复的
+	for _, visibility := range []time.Duration{time.Millisecond * 2, time.Second, time.Second * 30} {
+		connect := &redisBusConnect{setting: redisBusSetting{Visibility: visibility}}
+		if hold := connect.dedupHold(); hold <= 0 || hold >= visibility {
+			t.Errorf("visibility %v: hold %v", visibility, hold)
+		}
+	}
+}
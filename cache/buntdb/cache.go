@@ -3,16 +3,23 @@ package cache
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/arkgo/ark"
 	. "github.com/arkgo/asset"
 	"github.com/arkgo/asset/util"
+	"github.com/arkgo/driver/kit"
 	"github.com/tidwall/buntdb"
 )
 
 //-------------------- fileCacheBase begin -------------------------
 
+//支持的扩展
+var (
+	_ kit.StatsCache = (*fileCacheConnect)(nil)
+)
+
 type (
 	fileCacheDriver struct {
 		store string
@@ -25,6 +32,8 @@ type (
 		setting fileCacheSetting
 
 		db *buntdb.DB
+
+		hits, misses int64 //本连接的命中和未命中
 	}
 	fileCacheSetting struct {
 		Store  string
@@ -92,6 +101,23 @@ func (connect *fileCacheConnect) Close() error {
 	return nil
 }
 
+//缓存统计，条数加上本连接的命中和未命中
+func (connect *fileCacheConnect) Stats() (kit.CacheStats, error) {
+	stats := kit.CacheStats{
+		Hits: atomic.LoadInt64(&connect.hits), Misses: atomic.LoadInt64(&connect.misses),
+	}
+	if connect.db == nil {
+		return stats, errors.New("[缓存]连接失败")
+	}
+
+	err := connect.db.View(func(tx *buntdb.Tx) error {
+		count, err := tx.Len()
+		stats.Entries = int64(count)
+		return err
+	})
+	return stats, err
+}
+
 //查询缓存，
 func (connect *fileCacheConnect) Read(key string) (Any, error) {
 	if connect.db == nil {
@@ -110,11 +136,13 @@ func (connect *fileCacheConnect) Read(key string) (Any, error) {
 		return nil
 	})
 	if err == buntdb.ErrNotFound {
+		atomic.AddInt64(&connect.misses, 1)
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
+	atomic.AddInt64(&connect.hits, 1)
 
 	mcv := fileCacheValue{}
 	err = ark.Unmarshal([]byte(realVal), &mcv)
@@ -193,25 +221,39 @@ func (connect *fileCacheConnect) Delete(key string) error {
 }
 
 func (connect *fileCacheConnect) Serial(key string, start, step int64) (int64, error) {
-	//加并发锁
-	connect.mutex.Lock()
-	defer connect.mutex.Unlock()
+	if connect.db == nil {
+		return int64(0), errors.New("[缓存]连接失败")
+	}
 
+	realKey := connect.config.Prefix + key
 	value := start
 
-	if val, err := connect.Read(key); err == nil {
-		if vv, ok := val.(float64); ok {
-			value = int64(vv)
-		} else if vv, ok := val.(int64); ok {
-			value = vv
+	//读和写在同一个事务里
+	err := connect.db.Update(func(tx *buntdb.Tx) error {
+		if realVal, err := tx.Get(realKey); err == nil {
+			mcv := fileCacheValue{}
+			if err := ark.Unmarshal([]byte(realVal), &mcv); err == nil {
+				if vv, ok := mcv.Value.(float64); ok {
+					value = int64(vv)
+				} else if vv, ok := mcv.Value.(int64); ok {
+					value = vv
+				}
+			}
+		} else if err != buntdb.ErrNotFound {
+			return err
 		}
-	}
 
-	//加数字
-	value += step
+		//加数字
+		value += step
 
-	//写入值，这个应该不过期
-	err := connect.Write(key, value, 0)
+		//写入值，这个应该不过期
+		bytes, err := ark.Marshal(fileCacheValue{value})
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set(realKey, string(bytes), nil)
+		return err
+	})
 	if err != nil {
 		return int64(0), err
 	}
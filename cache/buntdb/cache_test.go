@@ -0,0 +1,31 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/arkgo/ark"
+)
+
+func TestFileCacheStats(t *testing.T) {
+	connect, err := Driver(":memory:").Connect("test", ark.CacheConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer connect.Close()
+
+	connect.Write("a", "x")
+	connect.Write("b", "y")
+	connect.Read("a")
+	connect.Read("c")
+
+	stats, err := connect.(*fileCacheConnect).Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 2 || stats.Hits != 1 || stats.Misses != 1 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
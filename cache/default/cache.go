@@ -2,7 +2,7 @@ package cache
 
 import (
 	"errors"
-	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -10,6 +10,19 @@ import (
 	"github.com/arkgo/ark"
 	. "github.com/arkgo/asset"
 	"github.com/arkgo/asset/util"
+	"github.com/arkgo/driver/kit"
+)
+
+//默认缓存驱动，存在内存里
+//可以限制条数和字节数，超出时按lru或lfu淘汰，后台定时清理过期的
+
+var (
+	errDefaultCacheRead = errors.New("缓存读取失败")
+)
+
+//支持的扩展
+var (
+	_ kit.StatsCache = (*defaultCacheConnect)(nil)
 )
 
 type (
@@ -19,14 +32,15 @@ type (
 		name    string
 		config  ark.CacheConfig
 		setting defaultCacheSetting
-		caches  sync.Map
+		store   *defaultCacheStore
+		stopper *util.Stopper
 	}
 	defaultCacheSetting struct {
-		Expiry time.Duration
-	}
-	defaultCacheValue struct {
-		Value  Any
-		Expiry time.Time
+		Expiry  time.Duration
+		Entries int           //最大条数，0为不限制
+		Bytes   int64         //最大字节数，0为不限制，按序列化后的大小估算
+		Policy  string        //淘汰策略，lru或lfu
+		Janitor time.Duration //清理过期的间隔
 	}
 )
 
@@ -43,77 +57,124 @@ func (driver *defaultCacheDriver) Connect(name string, config ark.CacheConfig) (
 		}
 	}
 
+	if vv, ok := config.Setting["entries"].(int64); ok && vv > 0 {
+		setting.Entries = int(vv)
+	}
+	if vv, ok := config.Setting["bytes"].(int64); ok && vv > 0 {
+		setting.Bytes = vv
+	}
+	if vv, ok := config.Setting["bytes"].(string); ok && vv != "" {
+		if bytes, err := defaultCacheParseBytes(vv); err == nil {
+			setting.Bytes = bytes
+		}
+	}
+
+	setting.Policy = defaultCachePolicyLRU
+	if vv, ok := config.Setting["policy"].(string); ok && strings.ToLower(vv) == defaultCachePolicyLFU {
+		setting.Policy = defaultCachePolicyLFU
+	}
+
+	setting.Janitor = time.Minute
+	if vv, ok := config.Setting["janitor"].(int64); ok && vv > 0 {
+		setting.Janitor = time.Second * time.Duration(vv)
+	}
+	if vv, ok := config.Setting["janitor"].(string); ok && vv != "" {
+		td, err := util.ParseDuration(vv)
+		if err == nil && td > 0 {
+			setting.Janitor = td
+		}
+	}
+
 	return &defaultCacheConnect{
 		name: name, config: config, setting: setting,
-		caches: sync.Map{},
+		store:   newDefaultCacheStore(setting.Policy, setting.Entries, setting.Bytes),
+		stopper: util.NewStopper(),
 	}, nil
 }
 
 //打开连接
 func (connect *defaultCacheConnect) Open() error {
+	connect.stopper.RunWorker(connect.janitor)
 	return nil
 }
 func (connect *defaultCacheConnect) Health() (ark.CacheHealth, error) {
-	connect.mutex.RLock()
-	defer connect.mutex.RUnlock()
-	return ark.CacheHealth{Workload: 0}, nil
+	stats := connect.store.Stats()
+	return ark.CacheHealth{Workload: stats.Entries}, nil
 }
 
 //关闭连接
 func (connect *defaultCacheConnect) Close() error {
+	connect.stopper.Stop()
 	return nil
 }
 
-//查询缓存，
+//缓存统计，命中、未命中、淘汰的次数
+//ark.CacheHealth只有Workload，详细的从这里取
+func (connect *defaultCacheConnect) Stats() (kit.CacheStats, error) {
+	return connect.store.Stats(), nil
+}
+
+//查询缓存，过期的读取时删除
 func (connect *defaultCacheConnect) Read(key string) (Any, error) {
 	realkey := connect.config.Prefix + key
-	if value, ok := connect.caches.Load(realkey); ok {
-		if vv, ok := value.(defaultCacheValue); ok {
-			if vv.Expiry.Unix() > time.Now().Unix() {
-				return vv.Value, nil
-			} else {
-				//过期了就删除
-				connect.Delete(key)
-			}
-		}
+	if value, ok := connect.store.Get(realkey); ok {
+		return value, nil
 	}
-	return nil, errors.New("缓存读取失败")
+	return nil, errDefaultCacheRead
 }
 
 //更新缓存
 func (connect *defaultCacheConnect) Write(key string, val Any, expires ...time.Duration) error {
 	now := time.Now()
 
-	value := defaultCacheValue{
-		Value: val, Expiry: now.Add(connect.setting.Expiry),
-	}
+	expiry := now.Add(connect.setting.Expiry)
 	if len(expires) > 0 {
-		value.Expiry = now.Add(expires[0])
+		expiry = now.Add(expires[0])
 	}
 
 	realkey := connect.config.Prefix + key
-	connect.caches.Store(realkey, value)
 
-	return nil
+	size, err := connect.size(realkey, val)
+	if err != nil {
+		return err
+	}
+
+	return connect.store.Set(realkey, val, expiry, size)
+}
+
+//限制了字节数才需要估算大小
+func (connect *defaultCacheConnect) size(realkey string, val Any) (int64, error) {
+	if connect.setting.Bytes <= 0 {
+		return 0, nil
+	}
+	bytes, err := ark.Marshal(val)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(realkey) + len(bytes)), nil
 }
 
 //查询缓存，
 func (connect *defaultCacheConnect) Exists(key string) (bool, error) {
 	realykey := connect.config.Prefix + key
-	if _, ok := connect.caches.Load(realykey); ok {
-		return ok, nil
+	if connect.store.Exists(realykey) {
+		return true, nil
 	}
-	return false, errors.New("缓存读取失败")
+	return false, errDefaultCacheRead
 }
 
 //删除缓存
 func (connect *defaultCacheConnect) Delete(key string) error {
 	realykey := connect.config.Prefix + key
-	connect.caches.Delete(realykey)
+	connect.store.Delete(realykey)
 	return nil
 }
 
 func (connect *defaultCacheConnect) Serial(key string, start, step int64) (int64, error) {
+	//读和写之间不能被别的Serial插进来
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
 	value := start
 
 	if val, err := connect.Read(key); err == nil {
@@ -126,19 +187,22 @@ func (connect *defaultCacheConnect) Serial(key string, start, step int64) (int64
 
 	value += step
 
-	//写入值
-	err := connect.Write(key, value)
+	//计数器不过期也不淘汰，不然会从头再发，和redis、buntdb一样
+	realkey := connect.config.Prefix + key
+	size, err := connect.size(realkey, value)
 	if err != nil {
 		return int64(0), err
 	}
+	if err := connect.store.Pin(realkey, value, size); err != nil {
+		return int64(0), err
+	}
 
 	return value, nil
 }
 
 func (connect *defaultCacheConnect) Keys(prefixs ...string) ([]string, error) {
 	keys := []string{}
-	connect.caches.Range(func(k, v Any) bool {
-		key := fmt.Sprintf("%v", k)
+	for _, key := range connect.store.Keys() {
 		if connect.config.Prefix == "" {
 			//没有指定前缀，全部KEY都算进来，还要去掉默认前缀
 			key = strings.Replace(key, connect.config.Prefix, "", 1)
@@ -154,17 +218,56 @@ func (connect *defaultCacheConnect) Keys(prefixs ...string) ([]string, error) {
 				}
 			}
 		}
-		return true
-	})
+	}
 	return keys, nil
 }
 func (connect *defaultCacheConnect) Clear(prefixs ...string) error {
 	if keys, err := connect.Keys(prefixs...); err == nil {
 		for _, key := range keys {
-			connect.caches.Delete(key)
+			connect.store.Delete(key)
 		}
 		return nil
 	} else {
 		return err
 	}
 }
+
+//定时清理过期的，没人读的过期缓存也会被清掉
+func (connect *defaultCacheConnect) janitor() {
+	ticker := time.NewTicker(connect.setting.Janitor)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			connect.store.Purge()
+		case <-connect.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+//解析字节数，支持 1024、64KB、64MB、1GB
+func defaultCacheParseBytes(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "B")
+
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+
+	vv, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return vv * unit, nil
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arkgo/ark"
+	. "github.com/arkgo/asset"
+	"github.com/arkgo/driver/kit"
+)
+
+func testDefaultCache(t *testing.T, setting Map) *defaultCacheConnect {
+	connect, err := Driver().Connect("test", ark.CacheConfig{Expiry: "10ms", Setting: setting})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		connect.Close()
+	})
+	return connect.(*defaultCacheConnect)
+}
+
+func TestDefaultCacheSerial(t *testing.T) {
+	connect := testDefaultCache(t, Map{"entries": int64(2), "janitor": "5ms"})
+
+	for i := int64(1); i <= 3; i++ {
+		value, err := connect.Serial("serial", 0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != i {
+			t.Fatalf("serial: got %d want %d", value, i)
+		}
+	}
+
+	//写满触发淘汰，再等过了默认过期时间，计数器都还在
+	for _, key := range []string{"a", "b", "c", "d"} {
+		connect.Write(key, key)
+	}
+	time.Sleep(time.Millisecond * 20)
+	connect.store.Purge()
+
+	value, err := connect.Serial("serial", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 4 {
+		t.Fatalf("serial restarted: got %d", value)
+	}
+}
+
+func TestDefaultCacheStats(t *testing.T) {
+	connect := testDefaultCache(t, Map{"bytes": "64B"})
+
+	cache, ok := Any(connect).(kit.StatsCache)
+	if ok == false {
+		t.Fatal("default cache should implement kit.StatsCache")
+	}
+
+	connect.Write("a", "x")
+	connect.Read("a")
+	connect.Read("b")
+	if err := connect.Write("big", strings.Repeat("x", 100)); err != errDefaultCacheTooLarge {
+		t.Fatalf("oversized write: %v", err)
+	}
+
+	stats, err := cache.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 1 || stats.Hits != 1 || stats.Misses != 1 || stats.Bytes == 0 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
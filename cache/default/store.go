@@ -0,0 +1,317 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/arkgo/asset"
+	"github.com/arkgo/driver/kit"
+)
+
+//内存存储，限制条数和字节数，超出时按策略淘汰
+//lru淘汰最久没用的，lfu淘汰用得最少的，次数一样时淘汰最久没用的
+//固定的条目（Serial的计数器）不过期也不淘汰，单独放一个列表，不参与淘汰
+//淘汰光了也放不下的写入返回错误，不超出限制，也不动旧的值
+
+const (
+	defaultCachePolicyLRU = "lru"
+	defaultCachePolicyLFU = "lfu"
+)
+
+var (
+	errDefaultCacheTooLarge = errors.New("缓存超出字节数限制")
+	errDefaultCacheFull     = errors.New("缓存被固定的条目占满")
+)
+
+type (
+	defaultCacheStore struct {
+		mutex   sync.Mutex
+		policy  string
+		entries int   //最大条数，0为不限制
+		bytes   int64 //最大字节数，0为不限制
+
+		items  map[string]*list.Element
+		lru    *list.List         //lru策略，前面是最近用过的
+		freqs  map[int]*list.List //lfu策略，按使用次数分组，每组前面是最近用过的
+		min    int                //lfu策略，当前最少的使用次数
+		pins   *list.List         //固定的条目
+		pinned int64              //固定的条目占的字节数
+		used   int64
+
+		stats kit.CacheStats
+	}
+	defaultCacheEntry struct {
+		Key    string
+		Value  Any
+		Expiry time.Time
+		Size   int64
+		Freq   int
+		Pinned bool //固定的，不过期也不淘汰
+	}
+)
+
+func newDefaultCacheStore(policy string, entries int, bytes int64) *defaultCacheStore {
+	return &defaultCacheStore{
+		policy: policy, entries: entries, bytes: bytes,
+		items: make(map[string]*list.Element, 0), lru: list.New(), freqs: make(map[int]*list.List, 0),
+		pins: list.New(),
+	}
+}
+
+//读取，过期的顺便删掉
+func (store *defaultCacheStore) Get(key string) (Any, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	elem, ok := store.items[key]
+	if ok == false {
+		store.stats.Misses++
+		return nil, false
+	}
+
+	entry := elem.Value.(*defaultCacheEntry)
+	if entry.expired(time.Now()) {
+		store.remove(elem)
+		store.stats.Expirations++
+		store.stats.Misses++
+		return nil, false
+	}
+
+	store.touch(elem)
+	store.stats.Hits++
+	return entry.Value, true
+}
+
+//写入，先淘汰腾出位置再放进去，免得新写入的刚放进去就被淘汰
+//已经存在的保留使用次数，淘汰光了也放不下的不写入，旧的值保留
+func (store *defaultCacheStore) Set(key string, value Any, expiry time.Time, size int64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := store.fits(key, size); err != nil {
+		return err
+	}
+
+	freq := 1
+	if elem, ok := store.items[key]; ok {
+		freq = elem.Value.(*defaultCacheEntry).Freq + 1
+		store.remove(elem)
+	}
+	store.evict(size)
+
+	entry := &defaultCacheEntry{Key: key, Value: value, Expiry: expiry, Size: size, Freq: freq}
+	if store.policy == defaultCachePolicyLFU {
+		store.items[key] = store.freq(freq).PushFront(entry)
+		if store.min == 0 || freq < store.min {
+			store.min = freq
+		}
+	} else {
+		store.items[key] = store.lru.PushFront(entry)
+	}
+	store.used += size
+	return nil
+}
+
+//写入固定的条目，不过期也不淘汰，可能要淘汰别的腾出位置
+func (store *defaultCacheStore) Pin(key string, value Any, size int64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := store.fits(key, size); err != nil {
+		return err
+	}
+
+	if elem, ok := store.items[key]; ok {
+		store.remove(elem)
+	}
+	store.evict(size)
+
+	entry := &defaultCacheEntry{Key: key, Value: value, Size: size, Pinned: true}
+	store.items[key] = store.pins.PushFront(entry)
+	store.used += size
+	store.pinned += size
+	return nil
+}
+
+//淘汰光了能不能放下，固定的条目淘汰不掉，要替换的那条不算
+func (store *defaultCacheStore) fits(key string, size int64) error {
+	if store.bytes > 0 && size > store.bytes {
+		return errDefaultCacheTooLarge
+	}
+
+	pins, pinned := store.pins.Len(), store.pinned
+	if elem, ok := store.items[key]; ok && elem.Value.(*defaultCacheEntry).Pinned {
+		pins, pinned = pins-1, pinned-elem.Value.(*defaultCacheEntry).Size
+	}
+	if store.entries > 0 && pins >= store.entries {
+		return errDefaultCacheFull
+	}
+	if store.bytes > 0 && pinned+size > store.bytes {
+		return errDefaultCacheFull
+	}
+	return nil
+}
+
+//淘汰到放得下size大小，写入前fits检查过，剩下的固定条目一定放得下
+func (store *defaultCacheStore) evict(size int64) {
+	for len(store.items) > 0 && store.full(size) {
+		elem := store.victim()
+		if elem == nil {
+			break
+		}
+		store.remove(elem)
+		store.stats.Evictions++
+	}
+}
+
+//是否存在，不算命中
+func (store *defaultCacheStore) Exists(key string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	elem, ok := store.items[key]
+	if ok == false {
+		return false
+	}
+	return elem.Value.(*defaultCacheEntry).expired(time.Now()) == false
+}
+
+func (store *defaultCacheStore) Delete(key string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if elem, ok := store.items[key]; ok {
+		store.remove(elem)
+	}
+}
+
+func (store *defaultCacheStore) Keys() []string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	keys := make([]string, 0, len(store.items))
+	for key, _ := range store.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+//清掉过期的
+func (store *defaultCacheStore) Purge() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	for _, elem := range store.items {
+		if elem.Value.(*defaultCacheEntry).expired(now) {
+			store.remove(elem)
+			store.stats.Expirations++
+		}
+	}
+}
+
+func (store *defaultCacheStore) Stats() kit.CacheStats {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	stats := store.stats
+	stats.Entries, stats.Bytes = int64(len(store.items)), store.used
+	return stats
+}
+
+//再放进size大小的会不会超出限制
+func (store *defaultCacheStore) full(size int64) bool {
+	if store.entries > 0 && len(store.items) >= store.entries {
+		return true
+	}
+	if store.bytes > 0 && store.used+size > store.bytes {
+		return true
+	}
+	return false
+}
+
+//用过一次
+func (store *defaultCacheStore) touch(elem *list.Element) {
+	if elem.Value.(*defaultCacheEntry).Pinned {
+		return
+	}
+	if store.policy != defaultCachePolicyLFU {
+		store.lru.MoveToFront(elem)
+		return
+	}
+
+	entry := elem.Value.(*defaultCacheEntry)
+	store.unlink(elem)
+	if _, ok := store.freqs[entry.Freq]; ok == false && store.min == entry.Freq {
+		store.min++
+	}
+	entry.Freq++
+	store.items[entry.Key] = store.freq(entry.Freq).PushFront(entry)
+}
+
+//要淘汰的
+func (store *defaultCacheStore) victim() *list.Element {
+	if store.policy != defaultCachePolicyLFU {
+		return store.lru.Back()
+	}
+
+	if _, ok := store.freqs[store.min]; ok == false {
+		//删除过的分组，重新找最少的
+		store.min = 0
+		for freq, _ := range store.freqs {
+			if store.min == 0 || freq < store.min {
+				store.min = freq
+			}
+		}
+	}
+	if items, ok := store.freqs[store.min]; ok {
+		return items.Back()
+	}
+	return nil
+}
+
+func (store *defaultCacheStore) remove(elem *list.Element) {
+	entry := elem.Value.(*defaultCacheEntry)
+	store.unlink(elem)
+	delete(store.items, entry.Key)
+	store.used -= entry.Size
+	if entry.Pinned {
+		store.pinned -= entry.Size
+	}
+}
+
+//从所在的列表里拿掉
+func (store *defaultCacheStore) unlink(elem *list.Element) {
+	if elem.Value.(*defaultCacheEntry).Pinned {
+		store.pins.Remove(elem)
+		return
+	}
+	if store.policy != defaultCachePolicyLFU {
+		store.lru.Remove(elem)
+		return
+	}
+
+	entry := elem.Value.(*defaultCacheEntry)
+	if items, ok := store.freqs[entry.Freq]; ok {
+		items.Remove(elem)
+		if items.Len() == 0 {
+			delete(store.freqs, entry.Freq)
+		}
+	}
+}
+
+func (store *defaultCacheStore) freq(freq int) *list.List {
+	if items, ok := store.freqs[freq]; ok {
+		return items
+	}
+	items := list.New()
+	store.freqs[freq] = items
+	return items
+}
+
+//是否过期，固定的不过期
+func (entry *defaultCacheEntry) expired(now time.Time) bool {
+	return entry.Pinned == false && entry.Expiry.After(now) == false
+}
@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDefaultCacheStoreLRU(t *testing.T) {
+	store := newDefaultCacheStore(defaultCachePolicyLRU, 2, 0)
+	expiry := time.Now().Add(time.Minute)
+
+	store.Set("a", 1, expiry, 0)
+	store.Set("b", 2, expiry, 0)
+	store.Get("a")
+	store.Set("c", 3, expiry, 0)
+
+	if store.Exists("b") {
+		t.Fatal("b should be evicted")
+	}
+	if store.Exists("a") == false || store.Exists("c") == false {
+		t.Fatal("a and c should stay")
+	}
+	if stats := store.Stats(); stats.Evictions != 1 || stats.Entries != 2 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
+
+func TestDefaultCacheStoreLFU(t *testing.T) {
+	store := newDefaultCacheStore(defaultCachePolicyLFU, 2, 0)
+	expiry := time.Now().Add(time.Minute)
+
+	store.Set("a", 1, expiry, 0)
+	store.Set("b", 2, expiry, 0)
+	store.Get("a")
+	store.Get("a")
+	store.Get("b")
+	store.Set("c", 3, expiry, 0)
+
+	if store.Exists("b") {
+		t.Fatal("b should be evicted")
+	}
+	if store.Exists("a") == false || store.Exists("c") == false {
+		t.Fatal("a and c should stay")
+	}
+}
+
+func TestDefaultCacheStoreBytes(t *testing.T) {
+	store := newDefaultCacheStore(defaultCachePolicyLRU, 0, 10)
+	expiry := time.Now().Add(time.Minute)
+
+	store.Set("a", 1, expiry, 4)
+	store.Set("b", 2, expiry, 4)
+	store.Set("c", 3, expiry, 4)
+	if store.Exists("a") {
+		t.Fatal("a should be evicted")
+	}
+	if stats := store.Stats(); stats.Bytes != 8 {
+		t.Fatalf("bytes: %d", stats.Bytes)
+	}
+}
+
+func TestDefaultCacheStorePin(t *testing.T) {
+	store := newDefaultCacheStore(defaultCachePolicyLFU, 2, 0)
+	expiry := time.Now().Add(time.Minute)
+
+	store.Pin("serial", int64(1), 0)
+	for i := 0; i < 10; i++ {
+		store.Set(string(rune('a'+i)), i, expiry, 0)
+	}
+	if value, ok := store.Get("serial"); ok == false || value.(int64) != 1 {
+		t.Fatalf("pinned evicted: %v %v", value, ok)
+	}
+
+	//固定的不过期
+	store.Purge()
+	if store.Exists("serial") == false {
+		t.Fatal("pinned purged")
+	}
+
+	//覆盖写入后变回普通的
+	store.Set("serial", int64(2), time.Now().Add(-time.Second), 0)
+	if store.Exists("serial") {
+		t.Fatal("overwritten pinned should expire")
+	}
+}
+
+func TestDefaultCacheStoreOversized(t *testing.T) {
+	store := newDefaultCacheStore(defaultCachePolicyLRU, 0, 10)
+	expiry := time.Now().Add(time.Minute)
+
+	store.Set("a", 1, expiry, 4)
+	store.Set("b", 2, expiry, 4)
+	if err := store.Set("b", 3, expiry, 11); err != errDefaultCacheTooLarge {
+		t.Fatalf("oversized: %v", err)
+	}
+	//放不下的不会把别的都淘汰掉，旧值保留
+	if store.Exists("a") == false {
+		t.Fatal("a evicted by oversized entry")
+	}
+	if value, ok := store.Get("b"); ok == false || value != 2 {
+		t.Fatalf("b lost: %v %v", value, ok)
+	}
+	if err := store.Pin("b", 4, 11); err != errDefaultCacheTooLarge {
+		t.Fatalf("oversized pin: %v", err)
+	}
+	if value, ok := store.Get("b"); ok == false || value != 2 {
+		t.Fatalf("b lost by pin: %v %v", value, ok)
+	}
+	if stats := store.Stats(); stats.Evictions != 0 || stats.Bytes != 8 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
+
+func TestDefaultCacheStorePinnedFull(t *testing.T) {
+	store := newDefaultCacheStore(defaultCachePolicyLRU, 2, 10)
+	expiry := time.Now().Add(time.Minute)
+
+	store.Set("a", 1, expiry, 1)
+	if err := store.Pin("p1", 1, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Pin("p2", 1, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	//只剩固定的条目，淘汰不掉，返回错误而不是超出限制
+	if err := store.Set("b", 2, expiry, 1); err != errDefaultCacheFull {
+		t.Fatalf("entries full: %v", err)
+	}
+	if err := store.Pin("p3", 1, 1); err != errDefaultCacheFull {
+		t.Fatalf("pins full: %v", err)
+	}
+	//替换已经固定的不算多出来
+	if err := store.Pin("p2", 2, 4); err != nil {
+		t.Fatalf("replace pin: %v", err)
+	}
+	if stats := store.Stats(); stats.Entries != 2 || stats.Bytes != 8 {
+		t.Fatalf("stats: %+v", stats)
+	}
+
+	//字节数被固定的占满
+	store = newDefaultCacheStore(defaultCachePolicyLFU, 0, 10)
+	if err := store.Pin("p1", 1, 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("b", 2, expiry, 3); err != errDefaultCacheFull {
+		t.Fatalf("bytes full: %v", err)
+	}
+	if err := store.Set("b", 2, expiry, 2); err != nil {
+		t.Fatal(err)
+	}
+	if stats := store.Stats(); stats.Bytes != 10 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
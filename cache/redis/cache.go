@@ -2,18 +2,45 @@ package cache_redis
 
 import (
 	"errors"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/arkgo/ark"
 	. "github.com/arkgo/asset"
 	"github.com/arkgo/asset/util"
+	"github.com/arkgo/driver/kit"
+	kit_redis "github.com/arkgo/driver/kit/redis"
 
 	"github.com/gomodule/redigo/redis"
 )
 
 //-------------------- redisCacheBase begin -------------------------
 
+//支持的扩展
+var (
+	_ kit.StatsCache = (*redisCacheConnect)(nil)
+	_ kit.ScanCache  = (*redisCacheConnect)(nil)
+)
+
+var (
+	//不存在或者不是数字时从start开始，数字按整数格式写，避免cjson的科学计数法丢精度
+	redisCacheSerialScript = redis.NewScript(1, `
+local value = tonumber(ARGV[1])
+local raw = redis.call('GET', KEYS[1])
+if raw then
+	local ok, data = pcall(cjson.decode, raw)
+	if ok and type(data) == 'table' and tonumber(data.value) then
+		value = tonumber(data.value)
+	end
+end
+value = value + tonumber(ARGV[2])
+redis.call('SET', KEYS[1], '{"value":' .. string.format('%d', value) .. '}')
+return value
+`)
+)
+
 type (
 	redisCacheDriver  struct{}
 	redisCacheConnect struct {
@@ -156,31 +183,18 @@ func (connect *redisCacheConnect) Close() error {
 	return nil
 }
 
-func (connect *redisCacheConnect) Serial(key string, start, step int64) (int64, error) { //加并发锁
-	//加锁可以
-	connect.mutex.Lock()
-	defer connect.mutex.Unlock()
-
-	value := start
-
-	if val, err := connect.Read(key); err == nil {
-		if vv, ok := val.(float64); ok {
-			value = int64(vv)
-		} else if vv, ok := val.(int64); ok {
-			value = vv
-		}
+//在redis里用脚本原子地读、加、写，多节点共用也不会重复
+//值和Write写入的格式一样，Read可以直接读出来
+func (connect *redisCacheConnect) Serial(key string, start, step int64) (int64, error) {
+	if connect.client == nil {
+		return int64(0), errors.New("连接失败")
 	}
+	conn := connect.client.Get()
+	defer conn.Close()
 
-	//加数字
-	value += step
-
-	//写入值
-	err := connect.Write(key, value, 0)
-	if err != nil {
-		return int64(0), err
-	}
+	realKey := connect.config.Prefix + key
 
-	return value, nil
+	return redis.Int64(redisCacheSerialScript.Do(conn, realKey, start, step))
 }
 
 //查询缓存，
@@ -293,13 +307,15 @@ func (connect *redisCacheConnect) Clear(prefixs ...string) error {
 	conn := connect.client.Get()
 	defer conn.Close()
 
-	keys, err := connect.Keys(prefixs...)
-	if err != nil {
-		return err
+	if len(prefixs) == 0 {
+		prefixs = []string{""}
 	}
 
-	for _, key := range keys {
-		_, err := conn.Do("DEL", key)
+	//边扫边删，不用先把所有键读出来
+	for _, prefix := range prefixs {
+		err := kit_redis.Scan(conn, connect.config.Prefix+prefix+"*", func(keys []string) error {
+			return kit_redis.Unlink(conn, keys)
+		})
 		if err != nil {
 			return err
 		}
@@ -316,21 +332,97 @@ func (connect *redisCacheConnect) Keys(prefixs ...string) ([]string, error) {
 	conn := connect.client.Get()
 	defer conn.Close()
 
-	if len(prefixs) > 0 {
-		for _, prefix := range prefixs {
-			alls, _ := redis.Strings(conn.Do("KEYS", connect.config.Prefix+prefix+"*"))
+	if len(prefixs) == 0 {
+		prefixs = []string{""}
+	}
+
+	//SCAN可能重复返回同一个键
+	exists := make(map[string]bool, 0)
+	for _, prefix := range prefixs {
+		err := kit_redis.Scan(conn, connect.config.Prefix+prefix+"*", func(alls []string) error {
 			for _, key := range alls {
-				keys = append(keys, key)
+				if exists[key] == false {
+					exists[key] = true
+					keys = append(keys, key)
+				}
 			}
-		}
-	} else {
-		alls, _ := redis.Strings(conn.Do("KEYS", connect.config.Prefix+"*"))
-		for _, key := range alls {
-			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	return keys, nil
 }
 
+//逐批遍历前缀下的键，键量很大时不用一次全部读进内存
+//call返回false时停止，同一个键可能出现多次
+func (connect *redisCacheConnect) Scan(prefix string, call func([]string) bool) error {
+	if connect.client == nil {
+		return errors.New("连接失败")
+	}
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	errStop := errors.New("stop")
+	err := kit_redis.Scan(conn, connect.config.Prefix+prefix+"*", func(keys []string) error {
+		if call(keys) == false {
+			return errStop
+		}
+		return nil
+	})
+	if err == errStop {
+		return nil
+	}
+	return err
+}
+
+//缓存统计，用INFO和DBSIZE，统计的是整个redis服务器的
+func (connect *redisCacheConnect) Stats() (kit.CacheStats, error) {
+	stats := kit.CacheStats{}
+	if connect.client == nil {
+		return stats, errors.New("连接失败")
+	}
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	info, err := redis.String(conn.Do("INFO"))
+	if err != nil {
+		return stats, err
+	}
+	entries, err := redis.Int64(conn.Do("DBSIZE"))
+	if err != nil {
+		return stats, err
+	}
+
+	values := redisCacheInfo(info)
+	stats.Entries = entries
+	stats.Bytes = values["used_memory"]
+	stats.Hits = values["keyspace_hits"]
+	stats.Misses = values["keyspace_misses"]
+	stats.Evictions = values["evicted_keys"]
+	stats.Expirations = values["expired_keys"]
+	return stats, nil
+}
+
+//解析INFO里的整数项
+func redisCacheInfo(info string) map[string]int64 {
+	values := make(map[string]int64, 0)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pos := strings.Index(line, ":")
+		if pos < 0 {
+			continue
+		}
+		if vv, err := strconv.ParseInt(line[pos+1:], 10, 64); err == nil {
+			values[line[:pos]] = vv
+		}
+	}
+	return values
+}
+
 //-------------------- redisCacheBase end -------------------------
@@ -0,0 +1,22 @@
+package cache_redis
+
+import (
+	"testing"
+)
+
+func TestRedisCacheInfo(t *testing.T) {
+	info := "# Memory\r\nused_memory:1048576\r\nused_memory_human:1.00M\r\n\r\n# Stats\r\nkeyspace_hits:42\r\nkeyspace_misses:7\r\nevicted_keys:3\r\nexpired_keys:5\r\n"
+	values := redisCacheInfo(info)
+
+	want := map[string]int64{
+		"used_memory": 1048576, "keyspace_hits": 42, "keyspace_misses": 7, "evicted_keys": 3, "expired_keys": 5,
+	}
+	for key, value := range want {
+		if values[key] != value {
+			t.Errorf("%s: got %d want %d", key, values[key], value)
+		}
+	}
+	if _, ok := values["used_memory_human"]; ok {
+		t.Error("non numeric value parsed")
+	}
+}
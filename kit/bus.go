@@ -0,0 +1,72 @@
+package kit
+
+import (
+	"errors"
+	"time"
+)
+
+//------------------------- 队列扩展 begin --------------------------
+//ark的队列接口之外，驱动可选实现的扩展，用类型断言判断是否支持
+//
+//	if bus, ok := connect.(kit.EnvelopeBus); ok { ... }
+//
+//各驱动支持的扩展
+//default：EnvelopeBus、ErrorBus、RequestBus、ScheduleBus、InspectBus
+//redis：EnvelopeBus、ErrorBus、RequestBus、ScheduleBus、InspectBus
+//postgres、buntdb：EnvelopeBus、ErrorBus、InspectBus，信封的分区键不保证顺序，也不去重
+//postgres、buntdb 不支持 RequestBus，请求应答需要低延迟的双向通道
+
+var (
+	ErrInvalidTimeout = errors.New("无效的超时时间")
+)
+
+type (
+	//返回错误的处理器，返回错误和panic一样视为失败，按重试策略重试或转入死信
+	ErrorHandler func(string, []byte) error
+	//带信封的处理器，返回错误同样视为失败
+	EnvelopeHandler func(string, Envelope) error
+	//应答处理器，返回值作为应答
+	RespondHandler func(string, []byte) ([]byte, error)
+
+	//队列状态
+	QueueStats struct {
+		Name       string
+		Length     int64         //排队中的数量
+		Workers    int           //本节点的处理线程
+		Actives    int64         //本节点处理中的数量
+		Pending    int64         //已投递未确认的数量，只有redis的stream模式有
+		Oldest     time.Duration //最早排队的消息已经等了多久
+		Deadletter int64         //死信队列的数量
+	}
+
+	//支持返回错误的处理器
+	ErrorBus interface {
+		AcceptError(eventHandler, queueHandler ErrorHandler) error
+	}
+
+	//支持信封，带编号、分区键和头信息
+	EnvelopeBus interface {
+		AcceptEnvelope(eventHandler, queueHandler EnvelopeHandler) error
+		PublishEnvelope(name string, envelope Envelope, delays ...time.Duration) error
+		EnqueueEnvelope(name string, envelope Envelope, delays ...time.Duration) error
+	}
+
+	//支持请求应答
+	RequestBus interface {
+		Respond(name string, thread int, handler RespondHandler) error
+		Request(name string, data []byte, timeout time.Duration) ([]byte, error)
+	}
+
+	//支持定时任务，多节点时只有一个节点触发
+	ScheduleBus interface {
+		SchedulePublish(spec, name string, data []byte) error
+		ScheduleEnqueue(spec, name string, data []byte) error
+	}
+
+	//支持查看队列状态
+	InspectBus interface {
+		Inspect(names ...string) ([]QueueStats, error)
+	}
+)
+
+//------------------------- 队列扩展 end --------------------------
@@ -0,0 +1,35 @@
+package kit
+
+//------------------------- 缓存扩展 begin --------------------------
+//ark的缓存接口之外，驱动可选实现的扩展，用类型断言判断是否支持
+//
+//	if cache, ok := connect.(kit.StatsCache); ok { ... }
+//
+//各驱动支持的扩展
+//default：StatsCache
+//redis：StatsCache、ScanCache，统计的是整个redis服务器的，多个应用共用时会算在一起
+//buntdb：StatsCache，只有条数和本连接的命中、未命中
+
+type (
+	//缓存统计，驱动拿不到的项为0
+	CacheStats struct {
+		Entries     int64
+		Bytes       int64
+		Hits        int64
+		Misses      int64
+		Evictions   int64 //超出限制被淘汰的
+		Expirations int64 //过期被清掉的
+	}
+
+	//缓存统计
+	StatsCache interface {
+		Stats() (CacheStats, error)
+	}
+
+	//分批遍历键，call返回false时停止
+	ScanCache interface {
+		Scan(prefix string, call func([]string) bool) error
+	}
+)
+
+//------------------------- 缓存扩展 end --------------------------
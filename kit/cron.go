@@ -0,0 +1,161 @@
+package kit
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//------------------------- 定时表达式 begin --------------------------
+//支持 分 时 日 月 周 五段的cron表达式，每段支持 * , - /
+//也支持 @hourly、@daily 这类简写，和 @every 30s 这样的固定间隔
+//@every 的时间点按间隔对齐，各节点算出来的时间点是一样的，可以拿来做幂等
+
+var (
+	ErrCron = errors.New("无效的定时表达式")
+
+	cronAliases = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+type (
+	//定时表达式
+	Cron struct {
+		every time.Duration //固定间隔，不为0时忽略其它字段
+
+		minute, hour, day, month, week uint64
+		anyDay, anyWeek                bool
+	}
+)
+
+//解析定时表达式
+func ParseCron(spec string) (*Cron, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil || every <= 0 {
+			return nil, ErrCron
+		}
+		return &Cron{every: every}, nil
+	}
+	if vv, ok := cronAliases[spec]; ok {
+		spec = vv
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, ErrCron
+	}
+
+	cron := &Cron{anyDay: fields[2] == "*", anyWeek: fields[4] == "*"}
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	masks := []*uint64{&cron.minute, &cron.hour, &cron.day, &cron.month, &cron.week}
+	for i, field := range fields {
+		mask, err := cronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, err
+		}
+		*masks[i] = mask
+	}
+	//周日可以写0或7
+	if cron.week&(1<<7) != 0 {
+		cron.week |= 1
+	}
+
+	return cron, nil
+}
+
+//解析一段，返回位掩码
+func cronField(field string, min, max int) (uint64, error) {
+	mask := uint64(0)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if pos := strings.Index(part, "/"); pos >= 0 {
+			vv, err := strconv.Atoi(part[pos+1:])
+			if err != nil || vv <= 0 {
+				return 0, ErrCron
+			}
+			step, part = vv, part[:pos]
+		}
+
+		begin, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			vv, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, ErrCron
+			}
+			begin, end = vv, vv
+			if len(bounds) == 2 {
+				vv, err := strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, ErrCron
+				}
+				end = vv
+			} else if step > 1 {
+				end = max //如 5/15 表示从5开始每15
+			}
+		}
+		if begin < min || end > max || begin > end {
+			return 0, ErrCron
+		}
+
+		for i := begin; i <= end; i += step {
+			mask |= 1 << uint(i)
+		}
+	}
+	return mask, nil
+}
+
+//某时间之后的下一次时间，找不到返回零值
+func (cron *Cron) Next(from time.Time) time.Time {
+	if cron.every > 0 {
+		return from.Truncate(cron.every).Add(cron.every)
+	}
+
+	loc := from.Location()
+	t := from.Truncate(time.Second).Add(time.Minute - time.Duration(from.Second())*time.Second)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if cron.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if cron.matchDay(t) == false {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if cron.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if cron.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+//日和周都指定时满足一个即可，和标准cron一致
+func (cron *Cron) matchDay(t time.Time) bool {
+	day := cron.day&(1<<uint(t.Day())) != 0
+	week := cron.week&(1<<uint(t.Weekday())) != 0
+	if cron.anyDay || cron.anyWeek {
+		return day && week
+	}
+	return day || week
+}
+
+//------------------------- 定时表达式 end --------------------------
@@ -0,0 +1,73 @@
+package kit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	valid := []string{
+		"* * * * *", "0 0 1 1 *", "*/15 * * * *", "5/15 * * * *", "0 9-17 * * 1-5",
+		"0,30 * * * *", "0 0 * * 7", "@daily", "@hourly", "@every 30s",
+	}
+	for _, spec := range valid {
+		if _, err := ParseCron(spec); err != nil {
+			t.Errorf("%q: %v", spec, err)
+		}
+	}
+
+	invalid := []string{
+		"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *",
+		"* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *",
+		"@every", "@every 0s", "@every -1s", "@sometimes",
+	}
+	for _, spec := range invalid {
+		if _, err := ParseCron(spec); err != ErrCron {
+			t.Errorf("%q: want ErrCron, got %v", spec, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, 1, 31, 10, 20, 30, 0, time.UTC) //周三
+	cases := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 31, 10, 21, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 10, 30, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2024, 2, 1, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		//日和周都指定时满足一个即可
+		{"0 0 15 * 5", time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC)},
+		{"@every 1m", time.Date(2024, 1, 31, 10, 21, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		cron, err := ParseCron(c.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", c.spec, err)
+		}
+		if got := cron.Next(from); got.Equal(c.want) == false {
+			t.Errorf("%q: got %v want %v", c.spec, got, c.want)
+		}
+	}
+
+	//不存在的日期找不到
+	cron, _ := ParseCron("0 0 30 2 *")
+	if got := cron.Next(from); got.IsZero() == false {
+		t.Errorf("feb 30: got %v", got)
+	}
+}
+
+func TestCronEveryAligned(t *testing.T) {
+	cron, _ := ParseCron("@every 10s")
+	a := cron.Next(time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC))
+	b := cron.Next(time.Date(2024, 1, 1, 0, 0, 7, 0, time.UTC))
+	if a.Equal(b) == false || a.Second() != 10 {
+		t.Errorf("every not aligned: %v %v", a, b)
+	}
+}
@@ -0,0 +1,71 @@
+package kit
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/arkgo/ark"
+)
+
+//------------------------- 消息信封 begin --------------------------
+//发布和入队的消息都包在信封里，带上编号、分区键、头信息、重试次数和入队时间
+//要序列化的驱动在信封前加前缀，和裸消息区分，前缀里带版本，以后格式变了可以兼容解析
+
+const (
+	EnvelopeVersion = 1
+)
+
+var (
+	EnvelopePrefix = []byte("\x00ark.v1:")
+)
+
+type (
+	Envelope struct {
+		Version int               `json:"v"`
+		Id      string            `json:"id"`
+		Dedup   bool              `json:"dedup,omitempty"` //生产者指定了编号，按编号去重
+		Key     string            `json:"key,omitempty"`   //分区键，相同键的队列消息按顺序处理
+		Headers map[string]string `json:"headers,omitempty"`
+		Attempt int               `json:"attempt"` //已经重试的次数
+		Time    time.Time         `json:"time"`    //发布或入队的时间
+		Data    []byte            `json:"data"`
+	}
+)
+
+//补全信封，编号和时间为空时自动生成
+//第一次补全时编号已经有了，说明是生产者指定的，标记为要去重，自动生成的编号不去重
+func SealEnvelope(envelope Envelope) Envelope {
+	if envelope.Version == 0 && envelope.Id != "" {
+		envelope.Dedup = true
+	}
+	envelope.Version = EnvelopeVersion
+	if envelope.Id == "" {
+		envelope.Id = ark.Unique()
+	}
+	if envelope.Time.IsZero() {
+		envelope.Time = time.Now()
+	}
+	return envelope
+}
+
+//序列化信封，带上前缀
+func EncodeEnvelope(envelope Envelope) ([]byte, error) {
+	bytes, err := ark.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, EnvelopePrefix...), bytes...), nil
+}
+
+//解析信封，不是信封的裸消息原样放进Data
+func DecodeEnvelope(data []byte) Envelope {
+	if bytes.HasPrefix(data, EnvelopePrefix) {
+		envelope := Envelope{}
+		if err := ark.Unmarshal(data[len(EnvelopePrefix):], &envelope); err == nil {
+			return envelope
+		}
+	}
+	return Envelope{Data: data}
+}
+
+//------------------------- 消息信封 end --------------------------
@@ -0,0 +1,59 @@
+package kit
+
+import (
+	"testing"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	envelope := SealEnvelope(Envelope{Key: "order:1", Headers: map[string]string{"a": "b"}, Attempt: 2, Data: []byte("hello")})
+	if envelope.Id == "" || envelope.Time.IsZero() || envelope.Version != EnvelopeVersion {
+		t.Fatalf("not sealed: %+v", envelope)
+	}
+
+	data, err := EncodeEnvelope(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := DecodeEnvelope(data)
+	if decoded.Id != envelope.Id || decoded.Key != envelope.Key || decoded.Attempt != 2 ||
+		decoded.Headers["a"] != "b" || string(decoded.Data) != "hello" || decoded.Time.Equal(envelope.Time) == false {
+		t.Errorf("got %+v", decoded)
+	}
+}
+
+func TestEnvelopeDecodeRaw(t *testing.T) {
+	for _, raw := range []string{"hello", "", "\x00ark.v1:not json"} {
+		decoded := DecodeEnvelope([]byte(raw))
+		if string(decoded.Data) != raw || decoded.Id != "" {
+			t.Errorf("%q: got %+v", raw, decoded)
+		}
+	}
+}
+
+func TestSealEnvelopeKeepsId(t *testing.T) {
+	envelope := SealEnvelope(Envelope{Id: "fixed"})
+	if envelope.Id != "fixed" || envelope.Dedup == false {
+		t.Errorf("got %+v", envelope)
+	}
+}
+
+func TestSealEnvelopeDedup(t *testing.T) {
+	//自动生成的编号不去重，重试时再补全也不会变成要去重
+	envelope := SealEnvelope(Envelope{Data: []byte("x")})
+	if envelope.Dedup {
+		t.Errorf("generated id marked dedup: %+v", envelope)
+	}
+	envelope.Attempt++
+	if resealed := SealEnvelope(envelope); resealed.Dedup || resealed.Id != envelope.Id {
+		t.Errorf("resealed: %+v", resealed)
+	}
+
+	//指定的编号编码解码后还要去重
+	data, err := EncodeEnvelope(SealEnvelope(Envelope{Id: "m1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded := SealEnvelope(DecodeEnvelope(data)); decoded.Dedup == false {
+		t.Errorf("decoded: %+v", decoded)
+	}
+}
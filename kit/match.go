@@ -0,0 +1,130 @@
+package kit
+
+import (
+	"errors"
+	"strings"
+)
+
+//------------------------- 通配订阅 begin --------------------------
+//和redis的PSUBSCRIBE规则一致，各个驱动匹配的结果才会一样
+//* 匹配任意字符，包括 . 和 /，? 匹配单个字符，[abc] [a-z] [^a] 匹配字符集，\ 转义
+
+var (
+	ErrPattern = errors.New("无效的通配模式")
+)
+
+//是否通配订阅
+func Pattern(channel string) bool {
+	return strings.ContainsAny(channel, "*?[")
+}
+
+//检查通配模式，字符集没有结束或是转义在末尾的无效
+func ValidPattern(pattern string) error {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if i++; i >= len(pattern) {
+				return ErrPattern
+			}
+		case '[':
+			end := matchClassEnd(pattern[i:])
+			if end < 0 {
+				return ErrPattern
+			}
+			i += end
+		}
+	}
+	return nil
+}
+
+//是否匹配
+func Match(pattern, channel string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(channel); i++ {
+				if Match(pattern[1:], channel[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(channel) == 0 {
+				return false
+			}
+			channel = channel[1:]
+		case '[':
+			if len(channel) == 0 {
+				return false
+			}
+			end := matchClassEnd(pattern)
+			if end < 0 {
+				return false
+			}
+			if matchClass(pattern[1:end], channel[0]) == false {
+				return false
+			}
+			pattern, channel = pattern[end:], channel[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(channel) == 0 || pattern[0] != channel[0] {
+				return false
+			}
+			channel = channel[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(channel) == 0
+}
+
+//字符集结束的 ] 的位置，没有返回-1
+func matchClassEnd(pattern string) int {
+	for i := 1; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
+
+//字符是否在字符集里，class为 [] 中间的部分
+func matchClass(class string, c byte) bool {
+	not := false
+	if len(class) > 0 && class[0] == '^' {
+		not, class = true, class[1:]
+	}
+
+	match := false
+	for i := 0; i < len(class) && match == false; i++ {
+		switch {
+		case class[i] == '\\' && i+1 < len(class):
+			i++
+			match = class[i] == c
+		case i+2 < len(class) && class[i+1] == '-':
+			start, end := class[i], class[i+2]
+			if start > end {
+				start, end = end, start
+			}
+			match = c >= start && c <= end
+			i += 2
+		default:
+			match = class[i] == c
+		}
+	}
+	return match != not
+}
+
+//------------------------- 通配订阅 end --------------------------
@@ -0,0 +1,51 @@
+package kit
+
+import (
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, channel string
+		match            bool
+	}{
+		{"order.*", "order.created", true},
+		{"order.*", "order.created.v2", true},
+		{"order/*", "order/a/b", true},
+		{"order.*", "orders.created", false},
+		{"*", "", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"order.?", "order.a", true},
+		{"order.?", "order.ab", false},
+		{"[abc]x", "bx", true},
+		{"[abc]x", "dx", false},
+		{"[^abc]x", "dx", true},
+		{"[^abc]x", "ax", false},
+		{"[a-c]x", "bx", true},
+		{"[c-a]x", "bx", true},
+		{"[a-c]x", "dx", false},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{`[\]]`, "]", true},
+		{"order.created", "order.created", true},
+	}
+	for _, c := range cases {
+		if got := Match(c.pattern, c.channel); got != c.match {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.pattern, c.channel, got, c.match)
+		}
+	}
+}
+
+func TestValidPattern(t *testing.T) {
+	for _, pattern := range []string{"order.*", "[a-z]*", `a\*`, "a?"} {
+		if err := ValidPattern(pattern); err != nil {
+			t.Errorf("%q: %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"order.[ab", `order\`, `[a\]`} {
+		if err := ValidPattern(pattern); err != ErrPattern {
+			t.Errorf("%q: got %v", pattern, err)
+		}
+	}
+}
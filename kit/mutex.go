@@ -0,0 +1,146 @@
+package kit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/arkgo/ark"
+)
+
+//------------------------- 锁扩展 begin --------------------------
+//ark的锁接口之外，驱动可选实现的扩展，用类型断言判断是否支持
+//
+//	if mutex, ok := connect.(kit.ContextMutex); ok { ... }
+//
+//各驱动支持的扩展
+//default、redis、postgres：ContextMutex、RenewMutex、SharedMutex
+//file：ContextMutex、RenewMutex，只支持类unix系统
+//
+//所有驱动的Unlock都只解自己加的、还没过期的锁，不是持有者时返回错误
+
+type (
+	//等待加锁，锁被占着时等到拿到锁、超时或者ctx结束
+	ContextMutex interface {
+		LockContext(ctx context.Context, key string, expires ...time.Duration) error
+		LockTimeout(key string, wait time.Duration, expires ...time.Duration) error
+	}
+
+	//续租，Watch按锁定时间的三分之一自动续租，直到解锁、不再是持有者或者租约到期
+	RenewMutex interface {
+		Renew(key string, expires ...time.Duration) error
+		Watch(key string, expires ...time.Duration) error
+	}
+
+	//读锁和信号量，加锁返回令牌，释放时带上令牌
+	SharedMutex interface {
+		RLock(key string, expires ...time.Duration) (string, error)
+		RUnlock(key, token string) error
+		AcquireSemaphore(key string, limit int, expires ...time.Duration) (string, error)
+		ReleaseSemaphore(key, token string) error
+	}
+)
+
+//------------------------- 锁扩展 end --------------------------
+
+//------------------------- 看门狗 begin --------------------------
+//各驱动的Watch共用，按锁定时间的三分之一定时续租，每个键一个
+//续租返回不是持有者时停止；连接断了之类的错误继续重试，直到租约真的到期
+
+type (
+	Watchdog struct {
+		mutex   sync.Mutex
+		waiter  sync.WaitGroup
+		watches map[string]chan struct{}
+	}
+)
+
+func NewWatchdog() *Watchdog {
+	return &Watchdog{watches: make(map[string]chan struct{}, 0)}
+}
+
+//开始自动续租，同一个键已经有的先停掉，owner是驱动不是持有者的错误，name用于日志
+func (watchdog *Watchdog) Watch(name, key string, expiry time.Duration, owner error, renew func() error) {
+	stop := make(chan struct{})
+	watchdog.mutex.Lock()
+	watchdog.unwatch(key)
+	watchdog.watches[key] = stop
+	watchdog.waiter.Add(1)
+	watchdog.mutex.Unlock()
+
+	go func() {
+		defer watchdog.waiter.Done()
+
+		interval := expiry / 3
+		if interval < time.Millisecond {
+			interval = time.Millisecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		deadline := time.Now().Add(expiry)
+		for {
+			select {
+			case <-ticker.C:
+				//停止和到点同时发生时不再续
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				now := time.Now()
+				err := renew()
+				if err == nil {
+					deadline = now.Add(expiry)
+					continue
+				}
+				ark.Warning(name, key, err)
+				if errors.Is(err, owner) || time.Now().Before(deadline) == false {
+					watchdog.mutex.Lock()
+					if watchdog.watches[key] == stop {
+						watchdog.unwatch(key)
+					}
+					watchdog.mutex.Unlock()
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+//停止续租
+func (watchdog *Watchdog) Unwatch(key string) {
+	watchdog.mutex.Lock()
+	defer watchdog.mutex.Unlock()
+	watchdog.unwatch(key)
+}
+
+//停止所有的续租，等续租的协程都退出，之后还能再Watch
+func (watchdog *Watchdog) Stop() {
+	watchdog.mutex.Lock()
+	for key, _ := range watchdog.watches {
+		watchdog.unwatch(key)
+	}
+	watchdog.mutex.Unlock()
+	watchdog.waiter.Wait()
+}
+
+//调用方持有watchdog.mutex
+func (watchdog *Watchdog) unwatch(key string) {
+	if stop, ok := watchdog.watches[key]; ok {
+		close(stop)
+		delete(watchdog.watches, key)
+	}
+}
+
+//等待加锁，最多等wait
+func LockTimeout(wait time.Duration, lock func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	return lock(ctx)
+}
+
+//------------------------- 看门狗 end --------------------------
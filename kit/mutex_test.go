@@ -0,0 +1,113 @@
+package kit
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	errTestOwner   = errors.New("owner")
+	errTestNetwork = errors.New("network")
+)
+
+//等续租协程退出，超时算失败
+func testWatchdogStopped(t *testing.T, watchdog *Watchdog) {
+	done := make(chan struct{})
+	go func() {
+		watchdog.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watchdog not stopped")
+	}
+}
+
+func TestWatchdogRetry(t *testing.T) {
+	watchdog := NewWatchdog()
+
+	//连接出错了继续重试，恢复后还能续上
+	renews := int64(0)
+	watchdog.Watch("test", "a", time.Millisecond*30, errTestOwner, func() error {
+		if atomic.AddInt64(&renews, 1)%2 == 1 {
+			return errTestNetwork
+		}
+		return nil
+	})
+	time.Sleep(time.Millisecond * 100)
+	if got := atomic.LoadInt64(&renews); got < 4 {
+		t.Errorf("stopped on transient error after %d renews", got)
+	}
+	testWatchdogStopped(t, watchdog)
+}
+
+func TestWatchdogOwner(t *testing.T) {
+	watchdog := NewWatchdog()
+
+	//不是持有者了马上停
+	renews := int64(0)
+	watchdog.Watch("test", "a", time.Millisecond*30, errTestOwner, func() error {
+		atomic.AddInt64(&renews, 1)
+		return errTestOwner
+	})
+	time.Sleep(time.Millisecond * 60)
+	if got := atomic.LoadInt64(&renews); got != 1 {
+		t.Errorf("got %d renews after owner error", got)
+	}
+	testWatchdogStopped(t, watchdog)
+}
+
+func TestWatchdogExpired(t *testing.T) {
+	watchdog := NewWatchdog()
+
+	//一直出错，租约到期后停
+	renews := int64(0)
+	watchdog.Watch("test", "a", time.Millisecond*30, errTestOwner, func() error {
+		atomic.AddInt64(&renews, 1)
+		return errTestNetwork
+	})
+	time.Sleep(time.Millisecond * 100)
+	got := atomic.LoadInt64(&renews)
+	if got < 1 || got > 4 {
+		t.Errorf("got %d renews before expiry", got)
+	}
+	time.Sleep(time.Millisecond * 30)
+	if atomic.LoadInt64(&renews) != got {
+		t.Error("renewing after lease expired")
+	}
+	testWatchdogStopped(t, watchdog)
+}
+
+func TestWatchdogUnwatch(t *testing.T) {
+	watchdog := NewWatchdog()
+
+	renews := int64(0)
+	watchdog.Watch("test", "a", time.Millisecond*15, errTestOwner, func() error {
+		atomic.AddInt64(&renews, 1)
+		return nil
+	})
+	time.Sleep(time.Millisecond * 30)
+	watchdog.Unwatch("a")
+	//已经在续的让它完成
+	time.Sleep(time.Millisecond * 5)
+	got := atomic.LoadInt64(&renews)
+	time.Sleep(time.Millisecond * 30)
+	if atomic.LoadInt64(&renews) != got {
+		t.Error("renewing after unwatch")
+	}
+	testWatchdogStopped(t, watchdog)
+}
+
+func TestLockTimeout(t *testing.T) {
+	err := LockTimeout(time.Millisecond*10, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package kit_redis
+
+import (
+	"strings"
+
+	. "github.com/arkgo/asset"
+	"github.com/gomodule/redigo/redis"
+)
+
+//------------------------- redis工具 begin --------------------------
+//缓存、会话等redis驱动共用的批量遍历和删除
+
+const (
+	ScanCount = 1000 //SCAN每批的数量，也是每次UNLINK的数量
+)
+
+//用SCAN分批遍历匹配的键，不会像KEYS那样长时间阻塞redis
+//同一个键可能返回多次，call返回错误时停止
+func Scan(conn redis.Conn, match string, call func([]string) error) error {
+	cursor := "0"
+	for {
+		vals, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", match, "COUNT", ScanCount))
+		if err != nil {
+			return err
+		}
+		if len(vals) < 2 {
+			return nil
+		}
+		cursor, err = redis.String(vals[0], nil)
+		if err != nil {
+			return err
+		}
+		keys, err := redis.Strings(vals[1], nil)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := call(keys); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+//批量删除，UNLINK在后台释放内存，老版本redis没有UNLINK就用DEL
+func Unlink(conn redis.Conn, keys []string) error {
+	args := make([]Any, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	_, err := conn.Do("UNLINK", args...)
+	if err != nil && strings.Contains(strings.ToLower(err.Error()), "unknown command") {
+		_, err = conn.Do("DEL", args...)
+	}
+	return err
+}
+
+//------------------------- redis工具 end --------------------------
@@ -0,0 +1,75 @@
+package kit_redis
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/arkgo/asset"
+)
+
+//按顺序回放的连接
+type testConn struct {
+	replies []Any
+	errs    []error
+	cmds    []string
+}
+
+func (conn *testConn) Close() error { return nil }
+func (conn *testConn) Err() error   { return nil }
+func (conn *testConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	conn.cmds = append(conn.cmds, cmd)
+	reply, err := conn.replies[0], conn.errs[0]
+	conn.replies, conn.errs = conn.replies[1:], conn.errs[1:]
+	return reply, err
+}
+func (conn *testConn) Send(cmd string, args ...interface{}) error { return nil }
+func (conn *testConn) Flush() error                               { return nil }
+func (conn *testConn) Receive() (interface{}, error)              { return nil, nil }
+
+func TestScan(t *testing.T) {
+	conn := &testConn{
+		replies: []Any{
+			[]Any{[]byte("12"), []Any{[]byte("a"), []byte("b")}},
+			[]Any{[]byte("7"), []Any{}},
+			[]Any{[]byte("0"), []Any{[]byte("c")}},
+		},
+		errs: []error{nil, nil, nil},
+	}
+
+	keys, batches := []string{}, 0
+	err := Scan(conn, "x*", func(batch []string) error {
+		batches++
+		keys = append(keys, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || batches != 2 || len(conn.cmds) != 3 {
+		t.Fatalf("keys %v batches %d cmds %v", keys, batches, conn.cmds)
+	}
+}
+
+func TestScanStop(t *testing.T) {
+	conn := &testConn{
+		replies: []Any{[]Any{[]byte("12"), []Any{[]byte("a")}}},
+		errs:    []error{nil},
+	}
+	stop := errors.New("stop")
+	if err := Scan(conn, "x*", func([]string) error { return stop }); err != stop {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestUnlinkFallback(t *testing.T) {
+	conn := &testConn{
+		replies: []Any{nil, int64(2)},
+		errs:    []error{errors.New("ERR unknown command 'UNLINK'"), nil},
+	}
+	if err := Unlink(conn, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.cmds) != 2 || conn.cmds[1] != "DEL" {
+		t.Fatalf("cmds %v", conn.cmds)
+	}
+}
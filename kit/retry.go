@@ -0,0 +1,134 @@
+package kit
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	. "github.com/arkgo/asset"
+	"github.com/arkgo/asset/util"
+)
+
+//------------------------- 重试和死信 begin --------------------------
+//各个队列驱动共用的重试策略，配置项为 retry、backoff、deadletter
+//queues 下可以按队列单独配置，没配置的项沿用默认的
+
+const (
+	RetryMaxBackoff = time.Hour
+)
+
+type (
+	//重试策略
+	Retry struct {
+		Retry      int           //最大重试次数，0为不重试
+		Backoff    time.Duration //首次重试间隔，之后按指数增长
+		Deadletter string        //超过重试次数后转入的死信队列，为空则丢弃
+	}
+	//默认的重试策略，加上按队列配置的
+	Retries struct {
+		Retry  Retry
+		Queues map[string]Retry
+	}
+)
+
+//解析重试策略，未配置的项沿用retry
+func RetrySetting(config Map, retry Retry) Retry {
+	if vv, ok := config["retry"].(int64); ok && vv >= 0 {
+		retry.Retry = int(vv)
+	}
+	if vv, ok := config["backoff"].(int64); ok && vv > 0 {
+		retry.Backoff = time.Second * time.Duration(vv)
+	}
+	if vv, ok := config["backoff"].(string); ok && vv != "" {
+		td, err := util.ParseDuration(vv)
+		if err == nil {
+			retry.Backoff = td
+		}
+	}
+	if vv, ok := config["deadletter"].(string); ok {
+		retry.Deadletter = vv
+	}
+	return retry
+}
+
+//解析按队列的重试策略，配置在 queues 下，未配置的项沿用retry
+func RetryQueues(config Map, retry Retry) map[string]Retry {
+	queues := make(map[string]Retry, 0)
+	if vvs, ok := config["queues"].(Map); ok {
+		for name, vv := range vvs {
+			if queue, ok := vv.(Map); ok {
+				queues[name] = RetrySetting(queue, retry)
+			}
+		}
+	}
+	return queues
+}
+
+//解析默认的和按队列的重试策略
+func RetriesSetting(config Map, retry Retry) Retries {
+	retry = RetrySetting(config, retry)
+	return Retries{Retry: retry, Queues: RetryQueues(config, retry)}
+}
+
+//队列的重试策略，没单独配置的用默认的
+func (retries Retries) Queue(name string) Retry {
+	if retry, ok := retries.Queues[name]; ok {
+		return retry
+	}
+	return retries.Retry
+}
+
+//第attempt次重试的间隔
+func (retry Retry) Delay(attempt int) time.Duration {
+	backoff := retry.Backoff
+	for i := 1; i < attempt && backoff < RetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > RetryMaxBackoff {
+		backoff = RetryMaxBackoff
+	}
+	return backoff
+}
+
+//调用处理器，panic也当作失败返回
+func Safe(call func() error) (err error) {
+	defer func() {
+		if res := recover(); res != nil {
+			err = fmt.Errorf("%v", res)
+		}
+	}()
+	return call()
+}
+
+//调用处理器，处理期间actives都加一，返回错误或panic视为失败
+func Handle(call func() error, actives ...*int64) error {
+	for _, active := range actives {
+		atomic.AddInt64(active, 1)
+	}
+	defer func() {
+		for _, active := range actives {
+			atomic.AddInt64(active, -1)
+		}
+	}()
+	return Safe(call)
+}
+
+//统一成带信封、返回错误的处理器，优先用带信封的，再是返回错误的
+func Handler(envelope EnvelopeHandler, errored ErrorHandler, plain func(string, []byte)) EnvelopeHandler {
+	if envelope != nil {
+		return envelope
+	}
+	if errored != nil {
+		return func(name string, value Envelope) error {
+			return errored(name, value.Data)
+		}
+	}
+	return func(name string, value Envelope) error {
+		if plain != nil {
+			plain(name, value.Data)
+		}
+		return nil
+	}
+}
+
+//------------------------- 重试和死信 end --------------------------
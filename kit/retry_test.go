@@ -0,0 +1,104 @@
+package kit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/arkgo/asset"
+)
+
+func TestRetrySetting(t *testing.T) {
+	base := Retry{Retry: 3, Backoff: time.Second}
+
+	retry := RetrySetting(Map{"backoff": "500ms", "deadletter": "dead"}, base)
+	if retry.Retry != 3 || retry.Backoff != 500*time.Millisecond || retry.Deadletter != "dead" {
+		t.Errorf("got %+v", retry)
+	}
+
+	retry = RetrySetting(Map{"retry": int64(0), "backoff": int64(2)}, base)
+	if retry.Retry != 0 || retry.Backoff != 2*time.Second {
+		t.Errorf("got %+v", retry)
+	}
+}
+
+func TestRetryQueues(t *testing.T) {
+	base := Retry{Retry: 3, Backoff: time.Second}
+	queues := RetryQueues(Map{"queues": Map{"order": Map{"retry": int64(5)}, "bad": "x"}}, base)
+	if len(queues) != 1 || queues["order"].Retry != 5 || queues["order"].Backoff != time.Second {
+		t.Errorf("got %+v", queues)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	retry := Retry{Backoff: time.Second}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 100: RetryMaxBackoff} {
+		if got := retry.Delay(attempt); got != want {
+			t.Errorf("attempt %d got %v want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestSafe(t *testing.T) {
+	if err := Safe(func() error { panic("boom") }); err == nil || err.Error() != "boom" {
+		t.Errorf("got %v", err)
+	}
+	want := errors.New("failed")
+	if err := Safe(func() error { return want }); err != want {
+		t.Errorf("got %v", err)
+	}
+	if err := Safe(func() error { return nil }); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	retries := RetriesSetting(Map{"retry": int64(2), "queues": Map{"order": Map{"retry": int64(5)}}}, Retry{Backoff: time.Second})
+	if retry := retries.Queue("order"); retry.Retry != 5 || retry.Backoff != time.Second {
+		t.Fatalf("order: %+v", retry)
+	}
+	if retry := retries.Queue("other"); retry.Retry != 2 {
+		t.Fatalf("other: %+v", retry)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	var total, queue int64
+	err := Handle(func() error {
+		if total != 1 || queue != 1 {
+			t.Errorf("actives during call: %d %d", total, queue)
+		}
+		panic("boom")
+	}, &total, &queue)
+	if err == nil || err.Error() != "boom" {
+		t.Fatalf("panic not returned: %v", err)
+	}
+	if total != 0 || queue != 0 {
+		t.Fatalf("actives after call: %d %d", total, queue)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	envelope := Envelope{Data: []byte("x")}
+
+	called := ""
+	plain := Handler(nil, nil, func(name string, data []byte) { called = name + string(data) })
+	if err := plain("a", envelope); err != nil || called != "ax" {
+		t.Fatalf("plain: %v %s", err, called)
+	}
+
+	errored := Handler(nil, func(name string, data []byte) error { return errors.New(name) }, nil)
+	if err := errored("b", envelope); err == nil || err.Error() != "b" {
+		t.Fatalf("errored: %v", err)
+	}
+
+	//带信封的优先
+	enveloped := Handler(func(name string, value Envelope) error { return nil }, func(name string, data []byte) error { return errors.New(name) }, nil)
+	if err := enveloped("c", envelope); err != nil {
+		t.Fatalf("envelope: %v", err)
+	}
+
+	if err := Handler(nil, nil, nil)("d", envelope); err != nil {
+		t.Fatalf("nothing: %v", err)
+	}
+}
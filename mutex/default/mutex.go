@@ -1,28 +1,61 @@
 package mutex
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"time"
 
 	"github.com/arkgo/ark"
 	"github.com/arkgo/asset/util"
+	"github.com/arkgo/driver/kit"
 )
 
 //默认mutex驱动
+//检查和写入在同一把锁里完成，过期时间精确到纳秒
+//每次加锁生成令牌，Release时比对令牌，不是自己加的锁不能解
+//Lock加的锁按加锁顺序记下令牌，Unlock先消耗已经过期的令牌并返回错误
+//锁过期后又被Lock拿走，前一个持有者迟到的Unlock不会解掉新的锁
+//等待加锁时挂在锁的通知通道上，解锁或者锁到期时醒来重新抢
+//长时间的任务可以续租，或者开看门狗自动续租
+
+const (
+	defaultMutexSweep = time.Minute //清理过期锁的间隔
+)
+
+var (
+	errDefaultMutexExists = errors.New("已经存在同名锁")
+	errDefaultMutexOwner  = errors.New("不是锁的持有者")
+)
+
+//支持的扩展
+var (
+	_ kit.ContextMutex = (*defaultMutexConnect)(nil)
+	_ kit.RenewMutex   = (*defaultMutexConnect)(nil)
+	_ kit.SharedMutex  = (*defaultMutexConnect)(nil)
+)
 
 type (
 	defaultMutexDriver  struct{}
 	defaultMutexConnect struct {
-		name string
+		name    string
 		config  ark.MutexConfig
 		setting defaultMutexSetting
-		locks   sync.Map
+
+		mutex    sync.Mutex
+		locks    map[string]defaultMutexValue
+		owns     map[string][]string      //Lock加的锁的令牌，按加锁顺序
+		waits    map[string]chan struct{} //等待中的锁，解锁时关闭通知
+		reads    map[string]defaultMutexShare
+		permits  map[string]defaultMutexShare
+		stopper  *util.Stopper
+		watchdog *kit.Watchdog
 	}
 	defaultMutexSetting struct {
 		Expiry time.Duration
 	}
 	defaultMutexValue struct {
+		Token  string
 		Expiry time.Time
 	}
 )
@@ -41,50 +74,305 @@ func (driver *defaultMutexDriver) Connect(name string, config ark.MutexConfig) (
 
 	return &defaultMutexConnect{
 		name: name, config: config, setting: setting,
+		locks: make(map[string]defaultMutexValue, 0), owns: make(map[string][]string, 0), waits: make(map[string]chan struct{}, 0),
+		reads: make(map[string]defaultMutexShare, 0), permits: make(map[string]defaultMutexShare, 0),
+		stopper: util.NewStopper(), watchdog: kit.NewWatchdog(),
 	}, nil
 }
 
 //打开连接
 func (connect *defaultMutexConnect) Open() error {
+	connect.stopper.RunWorker(connect.sweeping)
 	return nil
 }
 
 func (connect *defaultMutexConnect) Health() (ark.MutexHealth, error) {
-	return ark.MutexHealth{Workload: 0}, nil
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	now, workload := time.Now(), int64(0)
+	for _, value := range connect.locks {
+		if value.Expiry.After(now) {
+			workload++
+		}
+	}
+	return ark.MutexHealth{Workload: workload}, nil
 }
 
 //关闭连接
 func (connect *defaultMutexConnect) Close() error {
+	connect.watchdog.Stop()
+	connect.stopper.Stop()
 	return nil
 }
 
-//待优化，加上超时设置
 func (connect *defaultMutexConnect) Lock(key string, expires ...time.Duration) error {
+	token, err := connect.Acquire(key, expires...)
+	if err != nil {
+		return err
+	}
+	connect.own(key, token)
+	return nil
+}
+
+//解锁，只解Lock加的、还没过期的锁
+//还有过期的令牌时先消耗过期的，返回错误，这是前一个持有者迟到的解锁
+func (connect *defaultMutexConnect) Unlock(key string) error {
+	realkey := connect.config.Prefix + key
+
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	tokens := connect.owns[realkey]
+	if len(tokens) == 0 {
+		return errDefaultMutexOwner
+	}
+
+	live := connect.live(realkey)
+	index := 0
+	for i, token := range tokens {
+		if token != live {
+			index = i
+			break
+		}
+	}
+	token := tokens[index]
+	tokens = append(tokens[:index:index], tokens[index+1:]...)
+	if len(tokens) > 0 {
+		connect.owns[realkey] = tokens
+	} else {
+		delete(connect.owns, realkey)
+	}
+
+	if token != live {
+		return errDefaultMutexOwner
+	}
+	connect.release(realkey)
+	return nil
+}
+
+//Lock加的、还没过期的锁的令牌，调用方持有connect.mutex
+func (connect *defaultMutexConnect) live(realkey string) string {
+	value, ok := connect.locks[realkey]
+	if ok == false || value.Expiry.After(time.Now()) == false {
+		return ""
+	}
+	for _, token := range connect.owns[realkey] {
+		if token == value.Token {
+			return token
+		}
+	}
+	return ""
+}
+
+//等待加锁，直到拿到锁或者ctx结束
+func (connect *defaultMutexConnect) LockContext(ctx context.Context, key string, expires ...time.Duration) error {
+	token, err := connect.AcquireContext(ctx, key, expires...)
+	if err != nil {
+		return err
+	}
+	connect.own(key, token)
+	return nil
+}
+
+//记下Lock加的锁的令牌
+func (connect *defaultMutexConnect) own(key, token string) {
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+	realkey := connect.config.Prefix + key
+	connect.owns[realkey] = append(connect.owns[realkey], token)
+}
+
+//等待加锁，最多等wait
+func (connect *defaultMutexConnect) LockTimeout(key string, wait time.Duration, expires ...time.Duration) error {
+	return kit.LockTimeout(wait, func(ctx context.Context) error {
+		return connect.LockContext(ctx, key, expires...)
+	})
+}
+
+//加锁，返回令牌，解锁时要带上
+func (connect *defaultMutexConnect) Acquire(key string, expires ...time.Duration) (string, error) {
+	realkey := connect.config.Prefix + key
+
+	expiry := connect.setting.Expiry
+	if len(expires) > 0 && expires[0] > 0 {
+		expiry = expires[0]
+	}
+
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
 	now := time.Now()
+	if value, ok := connect.locks[realkey]; ok && value.Expiry.After(now) {
+		return "", errDefaultMutexExists
+	}
+	//还有读锁
+	if connect.shared(connect.reads, realkey, now) > 0 {
+		return "", errDefaultMutexExists
+	}
+
+	value := defaultMutexValue{
+		Token: ark.Unique(), Expiry: now.Add(expiry),
+	}
+	connect.locks[realkey] = value
+
+	return value.Token, nil
+}
 
+//等待加锁，返回令牌
+func (connect *defaultMutexConnect) AcquireContext(ctx context.Context, key string, expires ...time.Duration) (string, error) {
 	realkey := connect.config.Prefix + key
+	for {
+		token, err := connect.Acquire(key, expires...)
+		if err != errDefaultMutexExists {
+			return token, err
+		}
 
-	if vv, ok := connect.locks.Load(realkey); ok {
-		if tm, ok := vv.(defaultMutexValue); ok {
-			if tm.Expiry.Unix() > now.Unix() {
-				return errors.New("已经存在同名锁")
+		//锁被占着，等解锁通知或者锁到期
+		connect.mutex.Lock()
+		wait, ok := connect.waits[realkey]
+		if ok == false {
+			wait = make(chan struct{})
+			connect.waits[realkey] = wait
+		}
+		expiry := connect.locks[realkey].Expiry
+		//被读锁占着，等最早的读锁到期
+		for _, vv := range connect.reads[realkey] {
+			if expiry.IsZero() || vv.Before(expiry) {
+				expiry = vv
 			}
 		}
+		connect.mutex.Unlock()
+
+		timer := time.NewTimer(time.Until(expiry))
+		select {
+		case <-wait:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		}
+		timer.Stop()
 	}
+}
 
-	value := defaultMutexValue{
-		Expiry: now.Add(connect.setting.Expiry),
+//按令牌解锁，锁已经过期或者被别人拿走了返回错误
+func (connect *defaultMutexConnect) Release(key, token string) error {
+	realkey := connect.config.Prefix + key
+
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	value, ok := connect.locks[realkey]
+	if ok == false || value.Token != token || value.Expiry.After(time.Now()) == false {
+		return errDefaultMutexOwner
 	}
-	if len(expires) > 0 {
-		value.Expiry = now.Add(expires[0])
+	connect.release(realkey)
+	return nil
+}
+
+//续租，Lock加的锁还在才延长，返回错误说明锁已经过期了
+func (connect *defaultMutexConnect) Renew(key string, expires ...time.Duration) error {
+	realkey := connect.config.Prefix + key
+
+	connect.mutex.Lock()
+	token := connect.live(realkey)
+	connect.mutex.Unlock()
+	if token == "" {
+		return errDefaultMutexOwner
 	}
+	return connect.Extend(key, token, expires...)
+}
 
-	connect.locks.Store(realkey, value)
+//按令牌续租
+func (connect *defaultMutexConnect) Extend(key, token string, expires ...time.Duration) error {
+	realkey := connect.config.Prefix + key
+
+	expiry := connect.setting.Expiry
+	if len(expires) > 0 && expires[0] > 0 {
+		expiry = expires[0]
+	}
 
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	now := time.Now()
+	value, ok := connect.locks[realkey]
+	if ok == false || value.Token != token || value.Expiry.After(now) == false {
+		return errDefaultMutexOwner
+	}
+	value.Expiry = now.Add(expiry)
+	connect.locks[realkey] = value
 	return nil
 }
-func (connect *defaultMutexConnect) Unlock(key string) error {
+
+//看门狗，按锁定时间的三分之一定时续租，直到解锁、不再是持有者、租约到期或者关闭连接
+func (connect *defaultMutexConnect) Watch(key string, expires ...time.Duration) error {
 	realkey := connect.config.Prefix + key
-	connect.locks.Delete(realkey)
+
+	expiry := connect.setting.Expiry
+	if len(expires) > 0 && expires[0] > 0 {
+		expiry = expires[0]
+	}
+
+	connect.watchdog.Watch("mutex.default.watch", realkey, expiry, errDefaultMutexOwner, func() error {
+		return connect.Renew(key, expiry)
+	})
 	return nil
 }
+
+//删除锁，唤醒等待的，停掉看门狗
+func (connect *defaultMutexConnect) release(realkey string) {
+	delete(connect.locks, realkey)
+	connect.watchdog.Unwatch(realkey)
+	connect.wake(realkey)
+}
+
+//唤醒等待的
+func (connect *defaultMutexConnect) wake(realkey string) {
+	if wait, ok := connect.waits[realkey]; ok {
+		close(wait)
+		delete(connect.waits, realkey)
+	}
+}
+
+//定时清理过期的锁
+func (connect *defaultMutexConnect) sweeping() {
+	ticker := time.NewTicker(defaultMutexSweep)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			connect.mutex.Lock()
+			for key, value := range connect.locks {
+				if value.Expiry.After(now) == false {
+					connect.release(key)
+				}
+			}
+			//没有还持有的锁了，过期的令牌不用再记着，迟到的Unlock照样返回错误
+			//还持有的留着过期的令牌，先给迟到的Unlock消耗
+			for key, _ := range connect.owns {
+				if connect.live(key) == "" {
+					delete(connect.owns, key)
+				}
+			}
+			for key, _ := range connect.reads {
+				connect.shared(connect.reads, key, now)
+			}
+			for key, _ := range connect.permits {
+				connect.shared(connect.permits, key, now)
+			}
+			//锁已经没有了，通知通道还留着的，唤醒等待的重新抢
+			for key, wait := range connect.waits {
+				if _, ok := connect.locks[key]; ok == false {
+					close(wait)
+					delete(connect.waits, key)
+				}
+			}
+			connect.mutex.Unlock()
+		case <-connect.stopper.ShouldStop():
+			return
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package mutex
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arkgo/ark"
+)
+
+func testDefaultMutex(t *testing.T) *defaultMutexConnect {
+	connect, err := Driver().Connect("test", ark.MutexConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		connect.Close()
+	})
+	return connect.(*defaultMutexConnect)
+}
+
+func TestDefaultMutexLock(t *testing.T) {
+	connect := testDefaultMutex(t)
+
+	if err := connect.Lock("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Lock("a"); err != errDefaultMutexExists {
+		t.Fatalf("second lock: %v", err)
+	}
+	if err := connect.Renew("a"); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	if err := connect.Unlock("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Unlock("a"); err != errDefaultMutexOwner {
+		t.Fatalf("double unlock: %v", err)
+	}
+	if err := connect.Lock("a"); err != nil {
+		t.Fatalf("relock: %v", err)
+	}
+}
+
+func TestDefaultMutexUnlockNotOwner(t *testing.T) {
+	connect := testDefaultMutex(t)
+
+	token, err := connect.Acquire("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Unlock("a"); err != errDefaultMutexOwner {
+		t.Fatalf("unlock acquired: %v", err)
+	}
+	if err := connect.Renew("a"); err != errDefaultMutexOwner {
+		t.Fatalf("renew acquired: %v", err)
+	}
+	if err := connect.Release("a", token); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultMutexExpiredTaken(t *testing.T) {
+	connect := testDefaultMutex(t)
+
+	if err := connect.Lock("a", time.Millisecond*10); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+
+	//过期后被别人拿走，原来的持有者解不了也续不了
+	token, err := connect.Acquire("a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Renew("a"); err != errDefaultMutexOwner {
+		t.Fatalf("renew taken: %v", err)
+	}
+	if err := connect.Unlock("a"); err != errDefaultMutexOwner {
+		t.Fatalf("unlock taken: %v", err)
+	}
+	if err := connect.Extend("a", token); err != nil {
+		t.Fatalf("lock released by non owner: %v", err)
+	}
+}
+
+func TestDefaultMutexExpiredRelocked(t *testing.T) {
+	connect := testDefaultMutex(t)
+
+	if err := connect.Lock("a", time.Millisecond*10); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+
+	//过期后又被Lock拿走，前一个持有者迟到的解锁不能解掉新的锁
+	if err := connect.Lock("a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Unlock("a"); err != errDefaultMutexOwner {
+		t.Fatalf("stale unlock: %v", err)
+	}
+	if err := connect.Lock("a"); err != errDefaultMutexExists {
+		t.Fatalf("lock released by stale unlock: %v", err)
+	}
+
+	//新的持有者还能续租和解锁
+	if err := connect.Renew("a"); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	if err := connect.Unlock("a"); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	if err := connect.Unlock("a"); err != errDefaultMutexOwner {
+		t.Fatalf("double unlock: %v", err)
+	}
+	if err := connect.Lock("a"); err != nil {
+		t.Fatalf("relock: %v", err)
+	}
+}
+
+func TestDefaultMutexRead(t *testing.T) {
+	connect := testDefaultMutex(t)
+
+	first, err := connect.RLock("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := connect.RLock("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Lock("a"); err != errDefaultMutexExists {
+		t.Fatalf("lock with readers: %v", err)
+	}
+
+	if err := connect.RUnlock("a", "other"); err != errDefaultMutexOwner {
+		t.Fatalf("unlock with wrong token: %v", err)
+	}
+	if err := connect.RUnlock("a", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.RUnlock("a", first); err != errDefaultMutexOwner {
+		t.Fatalf("unlock twice: %v", err)
+	}
+	if err := connect.Lock("a"); err != errDefaultMutexExists {
+		t.Fatalf("lock with one reader: %v", err)
+	}
+	if err := connect.RUnlock("a", second); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Lock("a"); err != nil {
+		t.Fatalf("lock without readers: %v", err)
+	}
+	if _, err := connect.RLock("a"); err != errDefaultMutexExists {
+		t.Fatalf("read with writer: %v", err)
+	}
+}
+
+func TestDefaultMutexSemaphore(t *testing.T) {
+	connect := testDefaultMutex(t)
+
+	tokens := []string{}
+	for i := 0; i < 2; i++ {
+		token, err := connect.AcquireSemaphore("a", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+	if _, err := connect.AcquireSemaphore("a", 2); err != errDefaultMutexFull {
+		t.Fatalf("acquire over limit: %v", err)
+	}
+
+	//不是持有者释放不掉别人的
+	if err := connect.ReleaseSemaphore("a", "other"); err != errDefaultMutexOwner {
+		t.Fatalf("release with wrong token: %v", err)
+	}
+	if _, err := connect.AcquireSemaphore("a", 2); err != errDefaultMutexFull {
+		t.Fatalf("acquire after wrong release: %v", err)
+	}
+
+	if err := connect.ReleaseSemaphore("a", tokens[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connect.AcquireSemaphore("a", 2); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+
+	//过期的自动让出
+	if _, err := connect.AcquireSemaphore("b", 1, time.Millisecond*10); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if _, err := connect.AcquireSemaphore("b", 1); err != nil {
+		t.Fatalf("acquire after expiry: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package mutex
+
+import (
+	"errors"
+	"time"
+
+	"github.com/arkgo/ark"
+)
+
+//读锁和信号量，同一个键可以有多个持有者，每个持有者各自过期
+//读锁之间不互斥，和写锁（Lock）互斥；信号量最多limit个持有者，和读写锁互不影响
+//加锁返回令牌，释放时带上令牌，只能释放自己持有的
+
+var (
+	errDefaultMutexFull = errors.New("信号量已满")
+)
+
+type (
+	defaultMutexShare map[string]time.Time //令牌和过期时间
+)
+
+//加读锁，有写锁时返回错误，返回令牌，解锁时要带上
+func (connect *defaultMutexConnect) RLock(key string, expires ...time.Duration) (string, error) {
+	realkey := connect.config.Prefix + key
+
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	now := time.Now()
+	if value, ok := connect.locks[realkey]; ok && value.Expiry.After(now) {
+		return "", errDefaultMutexExists
+	}
+
+	return connect.share(connect.reads, realkey, now, connect.expiry(expires...)), nil
+}
+
+//按令牌解读锁
+func (connect *defaultMutexConnect) RUnlock(key, token string) error {
+	realkey := connect.config.Prefix + key
+
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	return connect.unshare(connect.reads, realkey, token)
+}
+
+//获取信号量，已经有limit个持有者时返回错误，返回令牌，释放时要带上
+func (connect *defaultMutexConnect) AcquireSemaphore(key string, limit int, expires ...time.Duration) (string, error) {
+	realkey := connect.config.Prefix + key
+
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	now := time.Now()
+	if connect.shared(connect.permits, realkey, now) >= limit {
+		return "", errDefaultMutexFull
+	}
+
+	return connect.share(connect.permits, realkey, now, connect.expiry(expires...)), nil
+}
+
+//按令牌释放信号量
+func (connect *defaultMutexConnect) ReleaseSemaphore(key, token string) error {
+	realkey := connect.config.Prefix + key
+
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+
+	return connect.unshare(connect.permits, realkey, token)
+}
+
+func (connect *defaultMutexConnect) expiry(expires ...time.Duration) time.Duration {
+	if len(expires) > 0 && expires[0] > 0 {
+		return expires[0]
+	}
+	return connect.setting.Expiry
+}
+
+//有效的持有者数量，顺便清掉过期的，调用方持有connect.mutex
+func (connect *defaultMutexConnect) shared(shares map[string]defaultMutexShare, realkey string, now time.Time) int {
+	share, ok := shares[realkey]
+	if ok == false {
+		return 0
+	}
+	for token, expiry := range share {
+		if expiry.After(now) == false {
+			delete(share, token)
+		}
+	}
+	if len(share) == 0 {
+		delete(shares, realkey)
+	}
+	return len(share)
+}
+
+//加一个持有者，返回令牌
+func (connect *defaultMutexConnect) share(shares map[string]defaultMutexShare, realkey string, now time.Time, expiry time.Duration) string {
+	connect.shared(shares, realkey, now)
+	if _, ok := shares[realkey]; ok == false {
+		shares[realkey] = make(defaultMutexShare, 0)
+	}
+	token := ark.Unique()
+	shares[realkey][token] = now.Add(expiry)
+	return token
+}
+
+//按令牌去掉一个持有者，已经过期或者不是持有者返回错误，没有持有者了唤醒等待的
+func (connect *defaultMutexConnect) unshare(shares map[string]defaultMutexShare, realkey, token string) error {
+	share, ok := shares[realkey]
+	if ok == false {
+		return errDefaultMutexOwner
+	}
+	expiry, ok := share[token]
+	if ok == false {
+		return errDefaultMutexOwner
+	}
+	delete(share, token)
+
+	if len(share) == 0 {
+		delete(shares, realkey)
+		connect.wake(realkey)
+	}
+	if expiry.After(time.Now()) == false {
+		return errDefaultMutexOwner
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package mutex
+
+import (
+	"os"
+	"syscall"
+)
+
+//阻塞到拿到文件的排它锁
+func fileMutexFlock(handle *os.File) error {
+	for {
+		err := syscall.Flock(int(handle.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
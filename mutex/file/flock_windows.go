@@ -0,0 +1,11 @@
+package mutex
+
+import (
+	"errors"
+	"os"
+)
+
+//windows没有flock
+func fileMutexFlock(handle *os.File) error {
+	return errors.New("文件锁不支持windows")
+}
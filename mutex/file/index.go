@@ -0,0 +1,17 @@
+package mutex
+
+import (
+	"github.com/arkgo/ark"
+)
+
+func Driver(ss ...string) ark.MutexDriver {
+	store := ""
+	if len(ss) > 0 {
+		store = ss[0]
+	}
+	return &fileMutexDriver{store}
+}
+
+func init() {
+	ark.Register("file", Driver("store/mutex"))
+}
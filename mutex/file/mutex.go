@@ -0,0 +1,334 @@
+package mutex
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/arkgo/asset/util"
+	"github.com/arkgo/driver/kit"
+)
+
+//-------------------- fileMutex begin -------------------------
+//文件锁，同一台机器上的多个进程共用一个目录，每个锁一个文件，内容为令牌和过期时间
+//buntdb把整个库读进内存，多进程打开同一个文件看不到彼此的写入，所以这里直接用文件
+//读改写锁文件时持有文件的flock，进程崩溃时系统自动释放flock，不会留下卡死的锁
+//解锁时删掉锁文件，拿到flock后要确认文件还是目录里的那个，已经被删掉的重新打开
+
+const (
+	fileMutexPollMin = time.Millisecond * 5
+	fileMutexPollMax = time.Millisecond * 200
+)
+
+var (
+	errFileMutexExists = errors.New("已经存在同名锁")
+	errFileMutexOwner  = errors.New("不是锁的持有者")
+	errFileMutexFailed = errors.New("[锁]连接失败")
+)
+
+//支持的扩展
+var (
+	_ kit.ContextMutex = (*fileMutexConnect)(nil)
+	_ kit.RenewMutex   = (*fileMutexConnect)(nil)
+)
+
+type (
+	fileMutexDriver struct {
+		store string
+	}
+	fileMutexConnect struct {
+		mutex sync.RWMutex
+
+		name    string
+		config  ark.MutexConfig
+		setting fileMutexSetting
+
+		opened   bool
+		tokens   map[string]string //本连接持有的锁和令牌
+		watchdog *kit.Watchdog
+	}
+	fileMutexSetting struct {
+		Store  string //锁文件的目录
+		Expiry time.Duration
+	}
+	fileMutexValue struct {
+		Token  string `json:"token"`
+		Expiry int64  `json:"expiry"` //过期的纳秒时间
+	}
+)
+
+//连接
+func (driver *fileMutexDriver) Connect(name string, config ark.MutexConfig) (ark.MutexConnect, error) {
+
+	//获取配置信息
+	setting := fileMutexSetting{
+		Store:  driver.store,
+		Expiry: time.Second * 3,
+	}
+
+	//默认锁定时间
+	if config.Expiry != "" {
+		td, err := util.ParseDuration(config.Expiry)
+		if err == nil {
+			setting.Expiry = td
+		}
+	}
+
+	if vv, ok := config.Setting["file"].(string); ok && vv != "" {
+		setting.Store = vv
+	}
+	if vv, ok := config.Setting["store"].(string); ok && vv != "" {
+		setting.Store = vv
+	}
+
+	return &fileMutexConnect{
+		name: name, config: config, setting: setting,
+		tokens: make(map[string]string, 0), watchdog: kit.NewWatchdog(),
+	}, nil
+}
+
+//打开连接
+func (connect *fileMutexConnect) Open() error {
+	if connect.setting.Store == "" {
+		return errors.New("无效锁存储")
+	}
+	if err := os.MkdirAll(connect.setting.Store, 0755); err != nil {
+		return err
+	}
+
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+	connect.opened = true
+	return nil
+}
+func (connect *fileMutexConnect) Health() (ark.MutexHealth, error) {
+	connect.mutex.RLock()
+	defer connect.mutex.RUnlock()
+	return ark.MutexHealth{Workload: int64(len(connect.tokens))}, nil
+}
+
+//关闭连接，停掉看门狗
+func (connect *fileMutexConnect) Close() error {
+	connect.mutex.Lock()
+	connect.opened = false
+	connect.mutex.Unlock()
+
+	connect.watchdog.Stop()
+	return nil
+}
+
+func (connect *fileMutexConnect) isOpened() bool {
+	connect.mutex.RLock()
+	defer connect.mutex.RUnlock()
+	return connect.opened
+}
+
+//加锁，锁已经存在并且没过期返回错误
+func (connect *fileMutexConnect) Lock(key string, expires ...time.Duration) error {
+	if connect.isOpened() == false {
+		return errFileMutexFailed
+	}
+
+	realKey := connect.config.Prefix + key
+	expiry := connect.expiry(expires...)
+
+	token := ark.Unique()
+	err := connect.flock(connect.file(realKey), func(handle *os.File) error {
+		now := time.Now()
+		if value, err := fileMutexRead(handle); err == nil && value.Expiry > now.UnixNano() {
+			return errFileMutexExists
+		}
+		return fileMutexWrite(handle, fileMutexValue{token, now.Add(expiry).UnixNano()})
+	})
+	if err != nil {
+		return err
+	}
+
+	connect.mutex.Lock()
+	connect.tokens[realKey] = token
+	connect.mutex.Unlock()
+
+	return nil
+}
+
+//解锁，只删除本连接加的锁，锁已过期被别人拿走时不动
+func (connect *fileMutexConnect) Unlock(key string) error {
+	if connect.isOpened() == false {
+		return errFileMutexFailed
+	}
+
+	realKey := connect.config.Prefix + key
+
+	connect.mutex.Lock()
+	token, ok := connect.tokens[realKey]
+	delete(connect.tokens, realKey)
+	connect.watchdog.Unwatch(realKey)
+	connect.mutex.Unlock()
+
+	if ok == false {
+		return errFileMutexOwner
+	}
+
+	//过期的自己的锁也删掉，但锁已经过期或者被别人拿走了都返回错误
+	file := connect.file(realKey)
+	return connect.flock(file, func(handle *os.File) error {
+		value, err := fileMutexRead(handle)
+		if err != nil || value.Token != token {
+			return errFileMutexOwner
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		if value.Expiry <= time.Now().UnixNano() {
+			return errFileMutexOwner
+		}
+		return nil
+	})
+}
+
+//等待加锁，直到拿到锁或者ctx结束
+func (connect *fileMutexConnect) LockContext(ctx context.Context, key string, expires ...time.Duration) error {
+	poll := fileMutexPollMin
+	for {
+		err := connect.Lock(key, expires...)
+		if err != errFileMutexExists {
+			return err
+		}
+
+		timer := time.NewTimer(poll)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+
+		if poll *= 2; poll > fileMutexPollMax {
+			poll = fileMutexPollMax
+		}
+	}
+}
+
+//等待加锁，最多等wait
+func (connect *fileMutexConnect) LockTimeout(key string, wait time.Duration, expires ...time.Duration) error {
+	return kit.LockTimeout(wait, func(ctx context.Context) error {
+		return connect.LockContext(ctx, key, expires...)
+	})
+}
+
+//续租，锁还是本连接的才延长，返回错误说明锁已经丢了
+func (connect *fileMutexConnect) Renew(key string, expires ...time.Duration) error {
+	if connect.isOpened() == false {
+		return errFileMutexFailed
+	}
+
+	realKey := connect.config.Prefix + key
+	expiry := connect.expiry(expires...)
+
+	connect.mutex.RLock()
+	token, ok := connect.tokens[realKey]
+	connect.mutex.RUnlock()
+	if ok == false {
+		return errFileMutexOwner
+	}
+
+	return connect.flock(connect.file(realKey), func(handle *os.File) error {
+		now := time.Now()
+		value, err := fileMutexRead(handle)
+		if err != nil || value.Token != token || value.Expiry <= now.UnixNano() {
+			return errFileMutexOwner
+		}
+		return fileMutexWrite(handle, fileMutexValue{token, now.Add(expiry).UnixNano()})
+	})
+}
+
+//看门狗，按锁定时间的三分之一定时续租，直到解锁、不再是持有者、租约到期或者关闭连接
+func (connect *fileMutexConnect) Watch(key string, expires ...time.Duration) error {
+	realKey := connect.config.Prefix + key
+	expiry := connect.expiry(expires...)
+
+	//持有connect.mutex开始续租，关闭连接时不会漏掉
+	connect.mutex.Lock()
+	defer connect.mutex.Unlock()
+	if connect.opened == false {
+		return errFileMutexFailed
+	}
+	connect.watchdog.Watch("mutex.file.watch", realKey, expiry, errFileMutexOwner, func() error {
+		return connect.Renew(key, expiry)
+	})
+	return nil
+}
+
+func (connect *fileMutexConnect) expiry(expires ...time.Duration) time.Duration {
+	if len(expires) > 0 && expires[0] > 0 {
+		return expires[0]
+	}
+	return connect.setting.Expiry
+}
+
+//锁文件名，键可能带路径符号，用哈希
+func (connect *fileMutexConnect) file(realKey string) string {
+	hash := sha1.Sum([]byte(realKey))
+	return filepath.Join(connect.setting.Store, hex.EncodeToString(hash[:]))
+}
+
+//持有锁文件的flock执行，其它进程同时只能有一个在读改写这个锁
+func (connect *fileMutexConnect) flock(file string, call func(*os.File) error) error {
+	for {
+		handle, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		if err := fileMutexFlock(handle); err != nil {
+			handle.Close()
+			return err
+		}
+
+		//等flock的时候文件被别的进程解锁删掉了，锁在删掉的文件上没用，重新打开
+		current, err := os.Stat(file)
+		opened, openedErr := handle.Stat()
+		if err != nil || openedErr != nil || os.SameFile(current, opened) == false {
+			handle.Close()
+			continue
+		}
+
+		//关闭文件时flock自动释放
+		err = call(handle)
+		handle.Close()
+		return err
+	}
+}
+
+func fileMutexRead(handle *os.File) (fileMutexValue, error) {
+	value := fileMutexValue{}
+	if _, err := handle.Seek(0, io.SeekStart); err != nil {
+		return value, err
+	}
+	bytes, err := io.ReadAll(handle)
+	if err != nil {
+		return value, err
+	}
+	err = ark.Unmarshal(bytes, &value)
+	return value, err
+}
+
+func fileMutexWrite(handle *os.File, value fileMutexValue) error {
+	bytes, err := ark.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err := handle.Truncate(0); err != nil {
+		return err
+	}
+	_, err = handle.WriteAt(bytes, 0)
+	return err
+}
+
+//-------------------- fileMutex end -------------------------
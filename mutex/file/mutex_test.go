@@ -0,0 +1,149 @@
+package mutex
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arkgo/ark"
+)
+
+func testFileMutex(t *testing.T, store string) *fileMutexConnect {
+	connect, err := Driver(store).Connect("test", ark.MutexConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		connect.Close()
+	})
+	return connect.(*fileMutexConnect)
+}
+
+func TestFileMutexLock(t *testing.T) {
+	store := t.TempDir()
+	a, b := testFileMutex(t, store), testFileMutex(t, store)
+
+	if err := a.Lock("job"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Lock("job"); err != errFileMutexExists {
+		t.Fatalf("lock held by other: %v", err)
+	}
+	if err := b.Unlock("job"); err != errFileMutexOwner {
+		t.Fatalf("unlock by other: %v", err)
+	}
+	if err := b.Renew("job"); err != errFileMutexOwner {
+		t.Fatalf("renew by other: %v", err)
+	}
+	if err := a.Renew("job"); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+
+	if err := a.Unlock("job"); err != nil {
+		t.Fatal(err)
+	}
+	//解锁后锁文件删掉
+	if _, err := os.Stat(a.file("job")); os.IsNotExist(err) == false {
+		t.Fatalf("lock file left: %v", err)
+	}
+	if err := b.Lock("job"); err != nil {
+		t.Fatalf("lock after unlock: %v", err)
+	}
+}
+
+func TestFileMutexExpired(t *testing.T) {
+	store := t.TempDir()
+	a, b := testFileMutex(t, store), testFileMutex(t, store)
+
+	if err := a.Lock("job", time.Millisecond*20); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.LockTimeout("job", time.Second); err != nil {
+		t.Fatalf("lock after expiry: %v", err)
+	}
+	if err := a.Renew("job"); err != errFileMutexOwner {
+		t.Fatalf("renew taken: %v", err)
+	}
+	//过期被别人拿走了，解锁不能删别人的
+	if err := a.Unlock("job"); err != errFileMutexOwner {
+		t.Fatalf("unlock taken: %v", err)
+	}
+	if err := a.Lock("job"); err != errFileMutexExists {
+		t.Fatalf("lock removed by old owner: %v", err)
+	}
+	if err := a.LockTimeout("job", time.Millisecond*30); err == nil {
+		t.Fatal("lock timeout should fail")
+	}
+}
+
+func TestFileMutexWatch(t *testing.T) {
+	store := t.TempDir()
+	a, b := testFileMutex(t, store), testFileMutex(t, store)
+
+	if err := a.Lock("job", time.Millisecond*30); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Watch("job", time.Millisecond*30); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if err := b.Lock("job"); err != errFileMutexExists {
+		t.Fatalf("lock watched: %v", err)
+	}
+	if err := a.Unlock("job"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Lock("job"); err != nil {
+		t.Fatalf("lock after unlock: %v", err)
+	}
+}
+
+func TestFileMutexClose(t *testing.T) {
+	connect := testFileMutex(t, t.TempDir())
+	connect.Close()
+	if err := connect.Lock("job"); err != errFileMutexFailed {
+		t.Fatalf("lock after close: %v", err)
+	}
+	if err := connect.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect.Lock("job"); err != nil {
+		t.Fatalf("lock after reopen: %v", err)
+	}
+}
+
+func TestFileMutexExclusive(t *testing.T) {
+	store := t.TempDir()
+	connects := []*fileMutexConnect{testFileMutex(t, store), testFileMutex(t, store), testFileMutex(t, store)}
+
+	var holders, overlaps int64
+	var waiter sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		connect := connects[i%len(connects)]
+		waiter.Add(1)
+		go func() {
+			defer waiter.Done()
+			for j := 0; j < 10; j++ {
+				if err := connect.LockTimeout("job", time.Second*5, time.Second); err != nil {
+					t.Error(err)
+					return
+				}
+				if atomic.AddInt64(&holders, 1) > 1 {
+					atomic.AddInt64(&overlaps, 1)
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt64(&holders, -1)
+				connect.Unlock("job")
+			}
+		}()
+	}
+	waiter.Wait()
+	if overlaps > 0 {
+		t.Fatalf("%d overlaps", overlaps)
+	}
+}
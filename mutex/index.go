@@ -2,4 +2,7 @@ package mutex
 
 import (
 	_ "github.com/arkgo/driver/mutex/default"
+	_ "github.com/arkgo/driver/mutex/file"
+	_ "github.com/arkgo/driver/mutex/postgres"
+	_ "github.com/arkgo/driver/mutex/redis"
 )
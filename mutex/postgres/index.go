@@ -0,0 +1,35 @@
+package mutex_postgres
+
+import (
+	"github.com/arkgo/ark"
+	_ "github.com/lib/pq" //此包自动注册名为postgres的sql驱动
+)
+
+//只注册和postgres协议、功能都兼容的名字，timescale是postgres扩展，cockroach不支持pg_advisory_xact_lock和hashtext，不注册
+var (
+	SCHEMAS = []string{
+		"postgresql://",
+		"postgres://",
+		"pgsql://",
+		"pg://",
+		"timescale://",
+		"timescaledb://",
+		"tsdb://",
+	}
+	DRIVERS = []string{
+		"postgresql", "postgres", "pgsql", "pgdb", "pg",
+		"timescaledb", "timescale", "tsdb",
+	}
+)
+
+//返回驱动
+func Driver() ark.MutexDriver {
+	return &postgresMutexDriver{}
+}
+
+func init() {
+	driver := Driver()
+	for _, key := range DRIVERS {
+		ark.Register(key, driver)
+	}
+}
@@ -0,0 +1,365 @@
+package mutex_postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/arkgo/asset/util"
+	"github.com/arkgo/driver/kit"
+)
+
+//-------------------- postgres mutex begin -------------------------
+//锁存在租约表里，主键冲突时只有已过期的锁才能被覆盖，过期时间用数据库的时间，不受节点时钟影响
+//值为本次加锁的随机令牌，解锁时比对令牌，只删自己加的锁
+//等待加锁时轮询，间隔从短到长
+//长时间的任务可以续租，或者开看门狗自动续租
+
+const (
+	postgresMutexSweep   = time.Minute //清理过期锁的间隔
+	postgresMutexPollMin = time.Millisecond * 20
+	postgresMutexPollMax = time.Second
+)
+
+var (
+	errPostgresMutexExists = errors.New("已经存在同名锁")
+	errPostgresMutexFailed = errors.New("连接失败")
+	errPostgresMutexOwner  = errors.New("不是锁的持有者")
+)
+
+//支持的扩展
+var (
+	_ kit.ContextMutex = (*postgresMutexConnect)(nil)
+	_ kit.RenewMutex   = (*postgresMutexConnect)(nil)
+	_ kit.SharedMutex  = (*postgresMutexConnect)(nil)
+)
+
+type (
+	postgresMutexDriver  struct{}
+	postgresMutexConnect struct {
+		mutex sync.RWMutex
+
+		name    string
+		config  ark.MutexConfig
+		setting postgresMutexSetting
+
+		db       *sql.DB
+		stopper  *util.Stopper
+		watchdog *kit.Watchdog
+		tokens   map[string]postgresMutexToken //本连接持有的锁
+	}
+	postgresMutexSetting struct {
+		Url    string
+		Schema string
+		Table  string
+		Expiry time.Duration
+	}
+	postgresMutexToken struct {
+		Token  string
+		Expiry time.Time
+	}
+)
+
+//连接
+func (driver *postgresMutexDriver) Connect(name string, config ark.MutexConfig) (ark.MutexConnect, error) {
+
+	//获取配置信息
+	setting := postgresMutexSetting{
+		Schema: "public", Table: "mutex", Expiry: time.Second * 3,
+	}
+
+	//默认锁定时间
+	if config.Expiry != "" {
+		td, err := util.ParseDuration(config.Expiry)
+		if err == nil {
+			setting.Expiry = td
+		}
+	}
+
+	//连接串和数据驱动的url一样，同一个连接串可以同时给数据和锁用
+	if vv, ok := config.Setting["url"].(string); ok && vv != "" {
+		setting.Url = vv
+	}
+	//支持自定义的schema，和数据驱动一样
+	for _, s := range SCHEMAS {
+		if strings.HasPrefix(setting.Url, s) {
+			setting.Url = strings.Replace(setting.Url, s, "postgres://", 1)
+		}
+	}
+
+	if vv, ok := config.Setting["schema"].(string); ok && vv != "" {
+		setting.Schema = vv
+	}
+	if vv, ok := config.Setting["table"].(string); ok && vv != "" {
+		setting.Table = vv
+	}
+
+	return &postgresMutexConnect{
+		name: name, config: config, setting: setting, stopper: util.NewStopper(),
+		tokens: make(map[string]postgresMutexToken, 0), watchdog: kit.NewWatchdog(),
+	}, nil
+}
+
+//打开连接
+func (connect *postgresMutexConnect) Open() error {
+	if connect.setting.Url == "" {
+		return errors.New("[锁]无效连接")
+	}
+
+	db, err := sql.Open("postgres", connect.setting.Url)
+	if err != nil {
+		return err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return err
+	}
+
+	//建表
+	_, err = db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			"key" TEXT PRIMARY KEY,
+			"token" TEXT NOT NULL,
+			"expiry" TIMESTAMPTZ NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS %s (
+			"key" TEXT NOT NULL,
+			"kind" VARCHAR(10) NOT NULL,
+			"token" TEXT NOT NULL,
+			"expiry" TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY ("key", "token")
+		);
+	`, connect.table(), connect.shareTable()))
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	connect.db = db
+	connect.stopper.RunWorker(connect.sweeping)
+	return nil
+}
+func (connect *postgresMutexConnect) Health() (ark.MutexHealth, error) {
+	connect.mutex.RLock()
+	defer connect.mutex.RUnlock()
+	now, workload := time.Now(), int64(0)
+	for _, token := range connect.tokens {
+		if token.Expiry.After(now) {
+			workload++
+		}
+	}
+	return ark.MutexHealth{Workload: workload}, nil
+}
+
+//关闭连接
+func (connect *postgresMutexConnect) Close() error {
+	connect.watchdog.Stop()
+	connect.stopper.Stop()
+
+	if connect.db != nil {
+		if err := connect.db.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//加锁，锁已经存在并且没过期返回错误
+func (connect *postgresMutexConnect) Lock(key string, expires ...time.Duration) error {
+	if connect.db == nil {
+		return errPostgresMutexFailed
+	}
+
+	realKey := connect.config.Prefix + key
+
+	expiry := connect.expiry(expires...)
+
+	//有读锁时不能加
+	token := ark.Unique()
+	err := connect.transact(realKey, func(tx *sql.Tx) error {
+		readers, err := connect.countShare(tx, realKey, postgresMutexKindRead)
+		if err != nil {
+			return err
+		}
+		if readers > 0 {
+			return errPostgresMutexExists
+		}
+
+		query := fmt.Sprintf(`
+			INSERT INTO %s AS "m" ("key", "token", "expiry") VALUES ($1, $2, now() + $3 * interval '1 millisecond')
+			ON CONFLICT ("key") DO UPDATE SET "token" = EXCLUDED."token", "expiry" = EXCLUDED."expiry"
+			WHERE "m"."expiry" <= now()
+		`, connect.table())
+		result, err := tx.Exec(query, realKey, token, expiry.Milliseconds())
+		if err != nil {
+			return err
+		}
+		if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+			return errPostgresMutexExists
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	connect.mutex.Lock()
+	connect.tokens[realKey] = postgresMutexToken{token, time.Now().Add(expiry)}
+	connect.mutex.Unlock()
+
+	return nil
+}
+
+//解锁，只删除本连接加的锁，锁已过期被别人拿走时不动
+func (connect *postgresMutexConnect) Unlock(key string) error {
+	if connect.db == nil {
+		return errPostgresMutexFailed
+	}
+
+	realKey := connect.config.Prefix + key
+
+	connect.mutex.Lock()
+	token, ok := connect.tokens[realKey]
+	delete(connect.tokens, realKey)
+	connect.watchdog.Unwatch(realKey)
+	connect.mutex.Unlock()
+
+	if ok == false {
+		return errPostgresMutexOwner
+	}
+
+	//过期的自己的锁也删掉，但锁已经过期或者被别人拿走了都返回错误
+	held := false
+	query := fmt.Sprintf(`DELETE FROM %s WHERE "key" = $1 AND "token" = $2 RETURNING "expiry" > now()`, connect.table())
+	err := connect.db.QueryRow(query, realKey, token.Token).Scan(&held)
+	if err == sql.ErrNoRows || (err == nil && held == false) {
+		return errPostgresMutexOwner
+	}
+	return err
+}
+
+//等待加锁，直到拿到锁或者ctx结束
+func (connect *postgresMutexConnect) LockContext(ctx context.Context, key string, expires ...time.Duration) error {
+	poll := postgresMutexPollMin
+	for {
+		err := connect.Lock(key, expires...)
+		if err != errPostgresMutexExists {
+			return err
+		}
+
+		timer := time.NewTimer(poll)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+
+		if poll *= 2; poll > postgresMutexPollMax {
+			poll = postgresMutexPollMax
+		}
+	}
+}
+
+//等待加锁，最多等wait
+func (connect *postgresMutexConnect) LockTimeout(key string, wait time.Duration, expires ...time.Duration) error {
+	return kit.LockTimeout(wait, func(ctx context.Context) error {
+		return connect.LockContext(ctx, key, expires...)
+	})
+}
+
+//续租，锁还是本连接的才延长，返回错误说明锁已经丢了
+func (connect *postgresMutexConnect) Renew(key string, expires ...time.Duration) error {
+	if connect.db == nil {
+		return errPostgresMutexFailed
+	}
+
+	realKey := connect.config.Prefix + key
+
+	expiry := connect.setting.Expiry
+	if len(expires) > 0 && expires[0] > 0 {
+		expiry = expires[0]
+	}
+
+	connect.mutex.RLock()
+	token, ok := connect.tokens[realKey]
+	connect.mutex.RUnlock()
+	if ok == false {
+		return errPostgresMutexOwner
+	}
+
+	query := fmt.Sprintf(`
+		UPDATE %s SET "expiry" = now() + $3 * interval '1 millisecond'
+		WHERE "key" = $1 AND "token" = $2 AND "expiry" > now()
+	`, connect.table())
+	result, err := connect.db.Exec(query, realKey, token.Token, expiry.Milliseconds())
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return errPostgresMutexOwner
+	}
+
+	connect.mutex.Lock()
+	if vv, ok := connect.tokens[realKey]; ok && vv.Token == token.Token {
+		connect.tokens[realKey] = postgresMutexToken{token.Token, time.Now().Add(expiry)}
+	}
+	connect.mutex.Unlock()
+
+	return nil
+}
+
+//看门狗，按锁定时间的三分之一定时续租，直到解锁、不再是持有者、租约到期或者关闭连接
+func (connect *postgresMutexConnect) Watch(key string, expires ...time.Duration) error {
+	realKey := connect.config.Prefix + key
+
+	expiry := connect.setting.Expiry
+	if len(expires) > 0 && expires[0] > 0 {
+		expiry = expires[0]
+	}
+
+	connect.watchdog.Watch("mutex.postgres.watch", realKey, expiry, errPostgresMutexOwner, func() error {
+		return connect.Renew(key, expiry)
+	})
+	return nil
+}
+
+//定时清理过期的锁
+func (connect *postgresMutexConnect) sweeping() {
+	ticker := time.NewTicker(postgresMutexSweep)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, table := range []string{connect.table(), connect.shareTable()} {
+				query := fmt.Sprintf(`DELETE FROM %s WHERE "expiry" <= now()`, table)
+				if _, err := connect.db.Exec(query); err != nil {
+					ark.Warning("mutex.postgres.sweep", err)
+				}
+			}
+			//过期没解锁的也不用再记着
+			now := time.Now()
+			connect.mutex.Lock()
+			for k, v := range connect.tokens {
+				if v.Expiry.Before(now) {
+					delete(connect.tokens, k)
+				}
+			}
+			connect.mutex.Unlock()
+		case <-connect.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+func (connect *postgresMutexConnect) table() string {
+	return fmt.Sprintf(`"%s"."%s"`, connect.setting.Schema, connect.setting.Table)
+}
+
+//-------------------- postgres mutex end -------------------------
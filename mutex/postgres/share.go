@@ -0,0 +1,148 @@
+package mutex_postgres
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/arkgo/ark"
+)
+
+//读锁和信号量，持有者存在共享表里，每个持有者一行，各自过期
+//同一个键的操作用事务级的advisory锁串行，检查和写入之间不会被插队
+//读锁之间不互斥，和写锁（Lock）互斥；信号量最多limit个持有者，和读写锁互不影响
+//加锁返回令牌，释放时带上令牌，只能释放自己持有的
+
+const (
+	postgresMutexKindRead      = "read"
+	postgresMutexKindSemaphore = "semaphore"
+)
+
+var (
+	errPostgresMutexFull = errors.New("信号量已满")
+)
+
+//加读锁，有写锁时返回错误，返回令牌，解锁时要带上
+func (connect *postgresMutexConnect) RLock(key string, expires ...time.Duration) (string, error) {
+	if connect.db == nil {
+		return "", errPostgresMutexFailed
+	}
+
+	realKey := connect.config.Prefix + key
+	token := ark.Unique()
+
+	err := connect.transact(realKey, func(tx *sql.Tx) error {
+		locked := 0
+		query := fmt.Sprintf(`SELECT count(*) FROM %s WHERE "key" = $1 AND "expiry" > now()`, connect.table())
+		if err := tx.QueryRow(query, realKey).Scan(&locked); err != nil {
+			return err
+		}
+		if locked > 0 {
+			return errPostgresMutexExists
+		}
+		return connect.insertShare(tx, realKey, postgresMutexKindRead, token, connect.expiry(expires...))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+//按令牌解读锁
+func (connect *postgresMutexConnect) RUnlock(key, token string) error {
+	return connect.unshare(postgresMutexKindRead, connect.config.Prefix+key, token)
+}
+
+//获取信号量，已经有limit个持有者时返回错误，返回令牌，释放时要带上
+func (connect *postgresMutexConnect) AcquireSemaphore(key string, limit int, expires ...time.Duration) (string, error) {
+	if connect.db == nil {
+		return "", errPostgresMutexFailed
+	}
+
+	realKey := connect.config.Prefix + key
+	token := ark.Unique()
+
+	err := connect.transact(realKey, func(tx *sql.Tx) error {
+		holders, err := connect.countShare(tx, realKey, postgresMutexKindSemaphore)
+		if err != nil {
+			return err
+		}
+		if holders >= limit {
+			return errPostgresMutexFull
+		}
+		return connect.insertShare(tx, realKey, postgresMutexKindSemaphore, token, connect.expiry(expires...))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+//按令牌释放信号量
+func (connect *postgresMutexConnect) ReleaseSemaphore(key, token string) error {
+	return connect.unshare(postgresMutexKindSemaphore, connect.config.Prefix+key, token)
+}
+
+func (connect *postgresMutexConnect) expiry(expires ...time.Duration) time.Duration {
+	if len(expires) > 0 && expires[0] > 0 {
+		return expires[0]
+	}
+	return connect.setting.Expiry
+}
+
+//在同一个键的advisory锁里执行
+func (connect *postgresMutexConnect) transact(realKey string, call func(*sql.Tx) error) error {
+	tx, err := connect.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, realKey); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := call(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//有效的持有者数量
+func (connect *postgresMutexConnect) countShare(tx *sql.Tx, realKey, kind string) (int, error) {
+	count := 0
+	query := fmt.Sprintf(`SELECT count(*) FROM %s WHERE "key" = $1 AND "kind" = $2 AND "expiry" > now()`, connect.shareTable())
+	err := tx.QueryRow(query, realKey, kind).Scan(&count)
+	return count, err
+}
+
+func (connect *postgresMutexConnect) insertShare(tx *sql.Tx, realKey, kind, token string, expiry time.Duration) error {
+	query := fmt.Sprintf(`
+		INSERT INTO %s ("key", "kind", "token", "expiry") VALUES ($1, $2, $3, now() + $4 * interval '1 millisecond')
+	`, connect.shareTable())
+	_, err := tx.Exec(query, realKey, kind, token, expiry.Milliseconds())
+	return err
+}
+
+//释放令牌，已经过期被清掉的返回错误
+func (connect *postgresMutexConnect) unshare(kind, realKey, token string) error {
+	if connect.db == nil {
+		return errPostgresMutexFailed
+	}
+
+	query := fmt.Sprintf(`DELETE FROM %s WHERE "key" = $1 AND "kind" = $2 AND "token" = $3`, connect.shareTable())
+	result, err := connect.db.Exec(query, realKey, kind, token)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return errPostgresMutexOwner
+	}
+	return nil
+}
+
+func (connect *postgresMutexConnect) shareTable() string {
+	return fmt.Sprintf(`"%s"."%s_share"`, connect.setting.Schema, connect.setting.Table)
+}
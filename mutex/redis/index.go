@@ -0,0 +1,13 @@
+package mutex_redis
+
+import (
+	"github.com/arkgo/ark"
+)
+
+func Driver() ark.MutexDriver {
+	return &redisMutexDriver{}
+}
+
+func init() {
+	ark.Register("redis", Driver())
+}
@@ -0,0 +1,375 @@
+package mutex_redis
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/arkgo/asset/util"
+	"github.com/arkgo/driver/kit"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+//-------------------- redis mutex begin -------------------------
+//SET NX PX 加锁，值为本次加锁的随机令牌，有读锁时不能加，解锁时比对令牌，只删自己加的锁
+//等待加锁时轮询，间隔从短到长并加随机抖动，不超过锁的剩余时间
+//长时间的任务可以续租，或者开看门狗自动续租
+
+var (
+	errRedisMutexExists = errors.New("已经存在同名锁")
+	errRedisMutexFailed = errors.New("连接失败")
+	errRedisMutexOwner  = errors.New("不是锁的持有者")
+
+	redisMutexUnlockScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+	redisMutexRenewScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+)
+
+//支持的扩展
+var (
+	_ kit.ContextMutex = (*redisMutexConnect)(nil)
+	_ kit.RenewMutex   = (*redisMutexConnect)(nil)
+	_ kit.SharedMutex  = (*redisMutexConnect)(nil)
+)
+
+type (
+	redisMutexDriver  struct{}
+	redisMutexConnect struct {
+		mutex   sync.RWMutex
+		actives int64
+
+		name    string
+		config  ark.MutexConfig
+		setting redisMutexSetting
+
+		client   *redis.Pool
+		tokens   map[string]redisMutexToken //本连接持有的锁
+		watchdog *kit.Watchdog
+	}
+	redisMutexSetting struct {
+		Server   string //服务器地址，ip:端口
+		Password string //服务器auth密码
+		Database string //数据库
+		Expiry   time.Duration
+
+		Idle    int //最大空闲连接
+		Active  int //最大激活连接，同时最大并发
+		Timeout time.Duration
+	}
+	redisMutexToken struct {
+		Token  string
+		Expiry time.Time
+	}
+)
+
+const (
+	redisMutexSweep   = 1024 //持有的锁超过这个数时清理已过期的
+	redisMutexPollMin = time.Millisecond * 10
+	redisMutexPollMax = time.Millisecond * 500
+)
+
+//连接
+func (driver *redisMutexDriver) Connect(name string, config ark.MutexConfig) (ark.MutexConnect, error) {
+
+	//获取配置信息
+	setting := redisMutexSetting{
+		Server: "127.0.0.1:6379", Password: "", Database: "",
+		Idle: 30, Active: 100, Timeout: time.Second * 240,
+		Expiry: time.Second * 3,
+	}
+
+	//默认锁定时间
+	if config.Expiry != "" {
+		td, err := util.ParseDuration(config.Expiry)
+		if err == nil {
+			setting.Expiry = td
+		}
+	}
+
+	if vv, ok := config.Setting["server"].(string); ok && vv != "" {
+		setting.Server = vv
+	}
+	if vv, ok := config.Setting["password"].(string); ok && vv != "" {
+		setting.Password = vv
+	}
+
+	//数据库，redis的0-16号
+	if v, ok := config.Setting["database"].(string); ok {
+		setting.Database = v
+	}
+
+	if vv, ok := config.Setting["idle"].(int64); ok && vv > 0 {
+		setting.Idle = int(vv)
+	}
+	if vv, ok := config.Setting["active"].(int64); ok && vv > 0 {
+		setting.Active = int(vv)
+	}
+	if vv, ok := config.Setting["timeout"].(int64); ok && vv > 0 {
+		setting.Timeout = time.Second * time.Duration(vv)
+	}
+	if vv, ok := config.Setting["timeout"].(string); ok && vv != "" {
+		td, err := util.ParseDuration(vv)
+		if err == nil {
+			setting.Timeout = td
+		}
+	}
+
+	return &redisMutexConnect{
+		name: name, config: config, setting: setting,
+		tokens: make(map[string]redisMutexToken, 0), watchdog: kit.NewWatchdog(),
+	}, nil
+}
+
+//打开连接
+func (connect *redisMutexConnect) Open() error {
+	connect.client = &redis.Pool{
+		MaxIdle: connect.setting.Idle, MaxActive: connect.setting.Active, IdleTimeout: connect.setting.Timeout,
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.Dial("tcp", connect.setting.Server)
+			if err != nil {
+				ark.Warning("mutex.redis.dial", err)
+				return nil, err
+			}
+
+			//如果有验证
+			if connect.setting.Password != "" {
+				if _, err := c.Do("AUTH", connect.setting.Password); err != nil {
+					c.Close()
+					ark.Warning("mutex.redis.auth", err)
+					return nil, err
+				}
+			}
+			//如果指定库
+			if connect.setting.Database != "" {
+				if _, err := c.Do("SELECT", connect.setting.Database); err != nil {
+					c.Close()
+					ark.Warning("mutex.redis.select", err)
+					return nil, err
+				}
+			}
+
+			return c, err
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+
+	//打开一个试一下
+	conn := connect.client.Get()
+	defer conn.Close()
+	return conn.Err()
+}
+func (connect *redisMutexConnect) Health() (ark.MutexHealth, error) {
+	connect.mutex.RLock()
+	defer connect.mutex.RUnlock()
+	now, workload := time.Now(), int64(0)
+	for _, token := range connect.tokens {
+		if token.Expiry.After(now) {
+			workload++
+		}
+	}
+	return ark.MutexHealth{Workload: workload}, nil
+}
+
+//关闭连接
+func (connect *redisMutexConnect) Close() error {
+	connect.watchdog.Stop()
+	if connect.client != nil {
+		if err := connect.client.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//加锁，锁已经存在返回错误
+func (connect *redisMutexConnect) Lock(key string, expires ...time.Duration) error {
+	if connect.client == nil {
+		return errRedisMutexFailed
+	}
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	realKey := connect.config.Prefix + key
+
+	expiry := connect.expiry(expires...)
+
+	token := ark.Unique()
+	ok, err := redis.Int(redisMutexLockScript.Do(conn, realKey, realKey+redisMutexReadKey, token, expiry.Milliseconds()))
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return errRedisMutexExists
+	}
+
+	connect.mutex.Lock()
+	now := time.Now()
+	if len(connect.tokens) >= redisMutexSweep {
+		for k, v := range connect.tokens {
+			if v.Expiry.Before(now) {
+				delete(connect.tokens, k)
+			}
+		}
+	}
+	connect.tokens[realKey] = redisMutexToken{token, now.Add(expiry)}
+	connect.mutex.Unlock()
+
+	return nil
+}
+
+//解锁，只删除本连接加的锁，锁已过期被别人拿走时不动
+func (connect *redisMutexConnect) Unlock(key string) error {
+	if connect.client == nil {
+		return errRedisMutexFailed
+	}
+
+	realKey := connect.config.Prefix + key
+
+	connect.mutex.Lock()
+	token, ok := connect.tokens[realKey]
+	delete(connect.tokens, realKey)
+	connect.watchdog.Unwatch(realKey)
+	connect.mutex.Unlock()
+
+	if ok == false {
+		return errRedisMutexOwner
+	}
+
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	//锁已经过期或者被别人拿走了，返回错误
+	count, err := redis.Int(redisMutexUnlockScript.Do(conn, realKey, token.Token))
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errRedisMutexOwner
+	}
+	return nil
+}
+
+//等待加锁，直到拿到锁或者ctx结束
+func (connect *redisMutexConnect) LockContext(ctx context.Context, key string, expires ...time.Duration) error {
+	poll := redisMutexPollMin
+	for {
+		err := connect.Lock(key, expires...)
+		if err != errRedisMutexExists {
+			return err
+		}
+
+		//锁快到期了就按剩余时间等
+		wait := poll
+		if ttl := connect.ttl(key); ttl > 0 && ttl < wait {
+			wait = ttl
+		}
+		wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+
+		if poll *= 2; poll > redisMutexPollMax {
+			poll = redisMutexPollMax
+		}
+	}
+}
+
+//等待加锁，最多等wait
+func (connect *redisMutexConnect) LockTimeout(key string, wait time.Duration, expires ...time.Duration) error {
+	return kit.LockTimeout(wait, func(ctx context.Context) error {
+		return connect.LockContext(ctx, key, expires...)
+	})
+}
+
+//续租，锁还是本连接的才延长，返回错误说明锁已经丢了
+func (connect *redisMutexConnect) Renew(key string, expires ...time.Duration) error {
+	if connect.client == nil {
+		return errRedisMutexFailed
+	}
+
+	realKey := connect.config.Prefix + key
+
+	expiry := connect.setting.Expiry
+	if len(expires) > 0 && expires[0] > 0 {
+		expiry = expires[0]
+	}
+
+	connect.mutex.RLock()
+	token, ok := connect.tokens[realKey]
+	connect.mutex.RUnlock()
+	if ok == false {
+		return errRedisMutexOwner
+	}
+
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	renewed, err := redis.Int(redisMutexRenewScript.Do(conn, realKey, token.Token, expiry.Milliseconds()))
+	if err != nil {
+		return err
+	}
+	if renewed == 0 {
+		return errRedisMutexOwner
+	}
+
+	connect.mutex.Lock()
+	if vv, ok := connect.tokens[realKey]; ok && vv.Token == token.Token {
+		connect.tokens[realKey] = redisMutexToken{token.Token, time.Now().Add(expiry)}
+	}
+	connect.mutex.Unlock()
+
+	return nil
+}
+
+//看门狗，按锁定时间的三分之一定时续租，直到解锁、不再是持有者、租约到期或者关闭连接
+func (connect *redisMutexConnect) Watch(key string, expires ...time.Duration) error {
+	realKey := connect.config.Prefix + key
+
+	expiry := connect.setting.Expiry
+	if len(expires) > 0 && expires[0] > 0 {
+		expiry = expires[0]
+	}
+
+	connect.watchdog.Watch("mutex.redis.watch", realKey, expiry, errRedisMutexOwner, func() error {
+		return connect.Renew(key, expiry)
+	})
+	return nil
+}
+
+//锁的剩余时间
+func (connect *redisMutexConnect) ttl(key string) time.Duration {
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	ttl, err := redis.Int64(conn.Do("PTTL", connect.config.Prefix+key))
+	if err != nil || ttl < 0 {
+		return 0
+	}
+	return time.Duration(ttl) * time.Millisecond
+}
+
+//-------------------- redis mutex end -------------------------
@@ -0,0 +1,145 @@
+package mutex_redis
+
+import (
+	"errors"
+	"time"
+
+	"github.com/arkgo/ark"
+	"github.com/gomodule/redigo/redis"
+)
+
+//读锁和信号量，持有者存在有序集合里，分数为过期的毫秒时间，每次操作先清掉过期的
+//读锁之间不互斥，和写锁（Lock）互斥；信号量最多limit个持有者，和读写锁互不影响
+//过期时间用redis服务器的时间，不受节点时钟影响
+//加锁返回令牌，释放时带上令牌，只能释放自己持有的
+
+const (
+	redisMutexReadKey      = ":_read"
+	redisMutexSemaphoreKey = ":_semaphore"
+
+	//服务器的毫秒时间，脚本里用了TIME之后还要写入，按效果复制
+	redisMutexTimeScript = `
+redis.replicate_commands()
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+`
+)
+
+var (
+	errRedisMutexFull = errors.New("信号量已满")
+
+	//写锁要等读锁都释放
+	redisMutexLockScript = redis.NewScript(2, redisMutexTimeScript+`
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+if redis.call('ZCARD', KEYS[2]) > 0 then
+	return 0
+end
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+return 0
+`)
+	redisMutexReadScript = redis.NewScript(2, redisMutexTimeScript+`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+redis.call('ZADD', KEYS[2], now + tonumber(ARGV[2]), ARGV[1])
+if redis.call('PTTL', KEYS[2]) < tonumber(ARGV[2]) then
+	redis.call('PEXPIRE', KEYS[2], ARGV[2])
+end
+return 1
+`)
+	redisMutexSemaphoreScript = redis.NewScript(1, redisMutexTimeScript+`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 1
+`)
+)
+
+//加读锁，有写锁时返回错误，返回令牌，解锁时要带上
+func (connect *redisMutexConnect) RLock(key string, expires ...time.Duration) (string, error) {
+	if connect.client == nil {
+		return "", errRedisMutexFailed
+	}
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	realKey := connect.config.Prefix + key
+	readKey := realKey + redisMutexReadKey
+
+	token := ark.Unique()
+	ok, err := redis.Int(redisMutexReadScript.Do(conn, realKey, readKey, token, connect.expiry(expires...).Milliseconds()))
+	if err != nil {
+		return "", err
+	}
+	if ok == 0 {
+		return "", errRedisMutexExists
+	}
+
+	return token, nil
+}
+
+//按令牌解读锁
+func (connect *redisMutexConnect) RUnlock(key, token string) error {
+	return connect.unshare(connect.config.Prefix+key+redisMutexReadKey, token)
+}
+
+//获取信号量，已经有limit个持有者时返回错误，返回令牌，释放时要带上
+func (connect *redisMutexConnect) AcquireSemaphore(key string, limit int, expires ...time.Duration) (string, error) {
+	if connect.client == nil {
+		return "", errRedisMutexFailed
+	}
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	semaphoreKey := connect.config.Prefix + key + redisMutexSemaphoreKey
+
+	token := ark.Unique()
+	ok, err := redis.Int(redisMutexSemaphoreScript.Do(conn, semaphoreKey, token, connect.expiry(expires...).Milliseconds(), limit))
+	if err != nil {
+		return "", err
+	}
+	if ok == 0 {
+		return "", errRedisMutexFull
+	}
+
+	return token, nil
+}
+
+//按令牌释放信号量
+func (connect *redisMutexConnect) ReleaseSemaphore(key, token string) error {
+	return connect.unshare(connect.config.Prefix+key+redisMutexSemaphoreKey, token)
+}
+
+func (connect *redisMutexConnect) expiry(expires ...time.Duration) time.Duration {
+	if len(expires) > 0 && expires[0] > 0 {
+		return expires[0]
+	}
+	return connect.setting.Expiry
+}
+
+//释放令牌，已经过期被清掉的返回错误
+func (connect *redisMutexConnect) unshare(shareKey, token string) error {
+	if connect.client == nil {
+		return errRedisMutexFailed
+	}
+
+	conn := connect.client.Get()
+	defer conn.Close()
+
+	removed, err := redis.Int(conn.Do("ZREM", shareKey, token))
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return errRedisMutexOwner
+	}
+	return nil
+}
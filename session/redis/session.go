@@ -7,6 +7,7 @@ import (
 	"github.com/arkgo/ark"
 	. "github.com/arkgo/asset"
 	"github.com/arkgo/asset/util"
+	kit_redis "github.com/arkgo/driver/kit/redis"
 	"github.com/gomodule/redigo/redis"
 )
 
@@ -237,17 +238,8 @@ func (connect *redisSessionConnect) Clear() error {
 	conn := connect.client.Get()
 	defer conn.Close()
 
-	keys, err := redis.Strings(conn.Do("KEYS", connect.config.Prefix+"*"))
-	if err != nil {
-		return err
-	}
-
-	for _, key := range keys {
-		_, err := conn.Do("DEL", key)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	//边扫边删，不用先把所有键读出来
+	return kit_redis.Scan(conn, connect.config.Prefix+"*", func(keys []string) error {
+		return kit_redis.Unlink(conn, keys)
+	})
 }